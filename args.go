@@ -0,0 +1,68 @@
+package rulebook
+
+import (
+	"strings"
+	"unicode"
+)
+
+// rawCommands take everything between their parens as their only argument.
+var rawCommands = map[string]bool{
+	"html": true,
+}
+
+func commandArgs(name string, raw string) []string {
+	if rawCommands[name] {
+		return []string{raw}
+	}
+
+	return parseArgs(raw)
+}
+
+// parseArgs splits the raw arguments of a command on commas. Arguments are
+// trimmed, double quotes keep commas and spaces verbatim, and a backslash
+// escapes the next character (\, \" \\).
+func parseArgs(raw string) []string {
+	args := []string{}
+	if strings.TrimSpace(raw) == "" {
+		return args
+	}
+
+	var arg strings.Builder
+	inQuote := false
+	escaped := false
+	// length of arg up to the last quoted or escaped character, which
+	// trailing whitespace trimming must not cut into.
+	kept := 0
+
+	flush := func() {
+		s := arg.String()
+		args = append(args, s[:kept]+strings.TrimRightFunc(s[kept:], unicode.IsSpace))
+		arg.Reset()
+		kept = 0
+	}
+
+	for _, r := range raw {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			kept = arg.Len()
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"':
+			inQuote = !inQuote
+			kept = arg.Len()
+		case inQuote:
+			arg.WriteRune(r)
+			kept = arg.Len()
+		case r == ',':
+			flush()
+		case unicode.IsSpace(r) && arg.Len() == 0:
+		default:
+			arg.WriteRune(r)
+		}
+	}
+	flush()
+
+	return args
+}
@@ -0,0 +1,31 @@
+package rulebook
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		raw  string
+		args []string
+	}{
+		{raw: "", args: []string{}},
+		{raw: "  ", args: []string{}},
+		{raw: "a", args: []string{"a"}},
+		{raw: " a ,b,  c ", args: []string{"a", "b", "c"}},
+		{raw: "a,,c", args: []string{"a", "", "c"}},
+		{raw: `"a, b", c`, args: []string{"a, b", "c"}},
+		{raw: `" padded ", x`, args: []string{" padded ", "x"}},
+		{raw: `a\, b, c`, args: []string{"a, b", "c"}},
+		{raw: `say \"hi\", "x \" y"`, args: []string{`say "hi"`, `x " y`}},
+		{raw: `back\\slash, end\ `, args: []string{`back\slash`, "end "}},
+		{raw: `unquoted, "quoted, with comma", escaped\, comma`, args: []string{"unquoted", "quoted, with comma", "escaped, comma"}},
+	}
+
+	for _, test := range tests {
+		if args := parseArgs(test.raw); !reflect.DeepEqual(args, test.args) {
+			t.Errorf("parseArgs(%q) = %q, want %q", test.raw, args, test.args)
+		}
+	}
+}
@@ -1,124 +1,604 @@
 package rulebook
 
 import (
+	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"path"
+	"strconv"
 	"strings"
 )
 
 type Section struct {
-	Title string
-	Items []item
+	Title       string    `json:"title"`
+	Items       []Item    `json:"items"`
+	SubSections []Section `json:"subSections,omitempty"`
 }
 
 type Chapter struct {
-	Title    string
-	Items    []item
-	Sections []Section
+	Title    string    `json:"title"`
+	Items    []Item    `json:"items"`
+	Sections []Section `json:"sections"`
+}
+
+type Annex struct {
+	Title    string    `json:"title"`
+	Items    []Item    `json:"items"`
+	Sections []Section `json:"sections"`
 }
 
 type Document struct {
-	Items    []item
-	Sections []Section
-	Chapters []Chapter
-	Annexes  []Section
+	Items    []Item    `json:"items"`
+	Sections []Section `json:"sections"`
+	Chapters []Chapter `json:"chapters"`
+	Annexes  []Annex   `json:"annexes"`
+
+	Meta map[string]string `json:"meta,omitempty"`
 }
 
-func toAnnex(n int) string {
-	return string(n + 65)
+func annexSectionNumber(annexIndex int, sectionIndex int) string {
+	return fmt.Sprintf("%s.%d", toAnnex(annexIndex), sectionIndex+1)
 }
 
-func Build(input io.Reader, w io.Writer, config BuilderConfig) error {
-	b, err := ioutil.ReadAll(input)
+func chapterSectionNumber(chapterIndex int, sectionIndex int) string {
+	return fmt.Sprintf("%s.%d", toRoman(chapterIndex+1), sectionIndex+1)
+}
+
+// Parse reads a whole rulebook into its document tree without rendering it.
+// Nothing is filtered out: \gmonly() blocks are kept as for the gm edition.
+func Parse(input io.Reader) (Document, error) {
+	return parse(context.Background(), input, BuilderConfig{Edition: "gm"})
+}
+
+func parse(ctx context.Context, input io.Reader, config BuilderConfig) (Document, error) {
+	document := Document{Chapters: make([]Chapter, 0), Items: make([]Item, 0), Sections: make([]Section, 0), Annexes: make([]Annex, 0)}
+
+	meta, input, lines, err := readFrontMatter(input)
 	if err != nil {
-		return err
+		return document, err
 	}
+	document.Meta = meta
 
-	lexer := lex(strings.Replace(string(b), "%", "%%", -1))
-
-	document := Document{Chapters: make([]Chapter, 0), Items: make([]item, 0), Sections: make([]Section, 0)}
+	lexer := lex(input)
+	lexer.line += lines
 
 	var chapter *Chapter
 	var sections *[]Section
-	var items *[]item
+	var items *[]Item
 	var section *Section
 
 	sections = &document.Sections
 	items = &document.Items
 
-	var it item
-	for it = lexer.nextItem(); it.typ != itemEOF && it.typ != itemError; it = lexer.nextItem() {
+	filter := editionFilter{edition: config.Edition}
+
+	var it Item
+	for it = lexer.nextItem(); it.typ != ItemEOF && it.typ != ItemError; it = lexer.nextItem() {
+		if it.typ == ItemNewLine {
+			if err := ctx.Err(); err != nil {
+				return document, err
+			}
+		}
+
+		keep, err := filter.keep(it)
+		if err != nil {
+			return document, err
+		}
+		if !keep {
+			continue
+		}
+
 		switch it.typ {
-		case itemChapter:
-			document.Chapters = append(document.Chapters, Chapter{Items: []item{}, Sections: make([]Section, 0)})
+		case ItemChapter:
+			document.Chapters = append(document.Chapters, Chapter{Items: []Item{}, Sections: make([]Section, 0)})
 			chapter = &document.Chapters[len(document.Chapters)-1]
 			chapter.Title = it.val
 			sections = &chapter.Sections
 			items = &chapter.Items
 			section = nil
-		case itemAnnex:
-			document.Annexes = append(document.Annexes, Section{Items: []item{}, Title: it.val})
+		case ItemAnnex:
+			document.Annexes = append(document.Annexes, Annex{Items: []Item{}, Title: it.val, Sections: make([]Section, 0)})
 			annex := &document.Annexes[len(document.Annexes)-1]
 			chapter = nil
+			sections = &annex.Sections
 			items = &annex.Items
-		case itemSection:
-			*sections = append(*sections, Section{Items: []item{}})
+			section = nil
+		case ItemSection:
+			*sections = append(*sections, Section{Items: []Item{}})
 			section = &((*sections)[len(*sections)-1])
 			section.Title = it.val
 			items = &section.Items
+		case ItemSubSection:
+			if section == nil {
+				return document, fmt.Errorf("line %d: sub-section %q outside of a section", it.line, it.val)
+			}
+			section.SubSections = append(section.SubSections, Section{Title: it.val, Items: []Item{}})
+			items = &section.SubSections[len(section.SubSections)-1].Items
 		default:
 			*items = append(*items, it)
 		}
 	}
 
-	if it.typ == itemError {
-		return fmt.Errorf("lexer error %+v", it)
+	if lexer.err != nil {
+		return document, lexer.err
 	}
 
-	builder := Builder{Config: config}
+	document.coalesceText()
+
+	return document, nil
+}
+
+// coalesceText merges runs of adjacent text items so they are rendered with a
+// single write.
+func coalesceText(items []Item) []Item {
+	out := items[:0]
+	for _, it := range items {
+		if it.typ == ItemText && len(out) > 0 && out[len(out)-1].typ == ItemText {
+			out[len(out)-1].val += it.val
+			continue
+		}
+		out = append(out, it)
+	}
+
+	return out
+}
+
+func (document *Document) coalesceText() {
+	document.Items = coalesceText(document.Items)
+	coalesceSections(document.Sections)
+	for i := range document.Chapters {
+		chapter := &document.Chapters[i]
+		chapter.Items = coalesceText(chapter.Items)
+		coalesceSections(chapter.Sections)
+	}
+	for i := range document.Annexes {
+		annex := &document.Annexes[i]
+		annex.Items = coalesceText(annex.Items)
+		coalesceSections(annex.Sections)
+	}
+}
 
-	out, err := builder.Build(document)
+func coalesceSections(sections []Section) {
+	for i := range sections {
+		sections[i].Items = coalesceText(sections[i].Items)
+		coalesceSections(sections[i].SubSections)
+	}
+}
+
+func Build(input io.Reader, w io.Writer, config BuilderConfig) error {
+	return BuildContext(context.Background(), input, w, config)
+}
+
+// BuildContext is Build giving up with the context error once ctx is done.
+func BuildContext(ctx context.Context, input io.Reader, w io.Writer, config BuilderConfig) error {
+	document, err := parse(ctx, input, config)
 	if err != nil {
 		return err
 	}
 
-	_, err = w.Write([]byte(out))
+	builder := Builder{Config: config}
+
+	return builder.buildTo(ctx, document, w)
+}
+
+// Lint builds the document without output and returns its warnings, such as
+// links to headings that do not exist.
+func Lint(input io.Reader, config BuilderConfig) ([]Warning, error) {
+	document, err := parse(context.Background(), input, config)
+	if err != nil {
+		return nil, err
+	}
+
+	builder := Builder{Config: config}
+	if err := builder.BuildTo(document, ioutil.Discard); err != nil {
+		return builder.Warnings, err
+	}
+
+	return builder.Warnings, nil
+}
+
+var blockCommands = map[string]bool{
+	"faq":       true,
+	"gmonly":    true,
+	"rtable":    true,
+	"tokens":    true,
+	"shortcuts": true,
+	"readaloud": true,
+	"flow":      true,
+	"begin":     true,
+}
+
+// admonitions are the kinds of \begin() boxes.
+var admonitions = map[string]bool{
+	"note":    true,
+	"warning": true,
+	"tip":     true,
+	"example": true,
+}
+
+func commandName(it Item) string {
+	return strings.SplitN(it.val, "|", 2)[0]
+}
+
+// editionFilter drops the content of \gmonly() blocks, headings included,
+// unless the gm edition is being built. A \gmonly() and its \end() must sit
+// at the same level of lists, tables, quotes and definition lists, otherwise
+// dropping the content would leave them unpaired.
+type editionFilter struct {
+	edition string
+	level   int
+	blocks  []filterBlock
+}
+
+// filterBlock is a block command the filter has seen opening; only gmonly ones
+// are checked for crossing structures.
+type filterBlock struct {
+	gmonly  bool
+	level   int
+	crossed bool
+}
+
+func (f *editionFilter) hidden() bool {
+	if f.edition == "gm" {
+		return false
+	}
+
+	for _, bl := range f.blocks {
+		if bl.gmonly {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *editionFilter) keep(it Item) (bool, error) {
+	switch it.typ {
+	case ItemListOpen, ItemStartListElement, ItemTableStart, ItemQuoteOpen, ItemDefListOpen:
+		f.level++
+	case ItemListClose, ItemEndListElement, ItemTableEnd, ItemQuoteClose, ItemDefListClose:
+		f.level--
+	}
+
+	for i := range f.blocks {
+		bl := &f.blocks[i]
+		switch {
+		case f.level < bl.level:
+			bl.crossed = true
+		case f.level == bl.level && (it.typ == ItemDefTerm || it.typ == ItemDefDesc):
+			bl.crossed = true
+		}
+	}
+
+	if it.typ != ItemCommand {
+		return !f.hidden(), nil
+	}
+
+	name := commandName(it)
+	if blockCommands[name] {
+		f.blocks = append(f.blocks, filterBlock{gmonly: name == "gmonly", level: f.level})
+		return !f.hidden(), nil
+	}
+
+	if name != "end" || len(f.blocks) == 0 {
+		return !f.hidden(), nil
+	}
+
+	keep := !f.hidden()
+	bl := f.blocks[len(f.blocks)-1]
+	f.blocks = f.blocks[:len(f.blocks)-1]
+	if bl.gmonly && (bl.crossed || f.level != bl.level) {
+		return false, fmt.Errorf("line %d: gmonly: \\end() must be at the level of its \\gmonly(), not across a list, table, quote or definition list", it.line)
+	}
 
-	return err
+	return keep, nil
 }
 
 type BuilderConfig struct {
-	TableOfContents bool
+	TableOfContents   bool
+	AnchorPrefix      string
+	Breadcrumbs       bool
+	TableDataLabels   bool
+	Edition           string
+	DefaultListType   string
+	IllustrationClass string
+	IndentListItems   bool
+	CompactPairTables bool
+	AllowRawHTML      bool
+	LeadSentence      bool
+	ErrataIndex       bool
+	Lang              string
+	NoHeadingHyphens  bool
+	StrictLinks       bool
+	Grayscale         bool
+	TOCSubSections    bool
+	Commands          map[string]CommandFunc
+	StrictCommands    bool
+	TOCDepth          int
+	TOCExcludeAnnexes bool
+	Labels            Labels
+	NumberSections    bool
+	BaseHeadingLevel  int
+	Standalone        bool
+	Title             string
+	StylesheetHref    string
+	TableCaption      bool
+	LazyImages        bool
+}
+
+// CommandFunc renders a custom \name(args) command to HTML.
+type CommandFunc func(args []string) (string, error)
+
+// Labels are the words the builders write around the content, the empty
+// ones keeping their French default.
+type Labels struct {
+	TableOfContents string
+	Annex           string
+	Licenses        string
+	SeeAlso         string
+	Figure          string
+	HitPoints       string
+	ArmorClass      string
+	Speed           string
+}
+
+func (l Labels) withDefaults() Labels {
+	if l.TableOfContents == "" {
+		l.TableOfContents = "Table des matières"
+	}
+	if l.Annex == "" {
+		l.Annex = "Annexe"
+	}
+	if l.Licenses == "" {
+		l.Licenses = "Licences"
+	}
+	if l.SeeAlso == "" {
+		l.SeeAlso = "Voir aussi :"
+	}
+	if l.Figure == "" {
+		l.Figure = "Figure"
+	}
+	if l.HitPoints == "" {
+		l.HitPoints = "Points de vie"
+	}
+	if l.ArmorClass == "" {
+		l.ArmorClass = "Classe d'armure"
+	}
+	if l.Speed == "" {
+		l.Speed = "Vitesse"
+	}
+
+	return l
+}
+
+type block struct {
+	name     string
+	close    string
+	implicit bool
+	line     int
+	onClose  func()
+}
+
+type Warning struct {
+	Line    int
+	Message string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("line %d: %s", w.Line, w.Message)
 }
 
 type Builder struct {
-	err             error
-	content         strings.Builder
-	paragraphIsOpen bool
-	newSection      bool
-	tableRowIndex   int
-	tableTitle      string
+	err              error
+	line             int
+	blocks           []block
+	out              io.Writer
+	paragraphIsOpen  bool
+	lineBreak        bool
+	leadIsOpen       bool
+	floatIsOpen      bool
+	newSection       bool
+	tableRowIndex    int
+	tableTitle       string
+	tableCaptionOnly bool
+	tableHeaders     []string
+	tableAligns      []string
+	tableRagged      bool
+	listTags         []string
+	ancestors        []crumb
+	randomTable      *randomTable
+	attributions     []string
+	errata           []string
+	targets          map[string]target
+	headings         headingAnchors
+	chapterNumber    string
+	sectionCount     int
+	tokens           [][2]string
+	flow             *flow
+	flowCount        int
+	figureCount      int
+	defTag           string
+	inline           bool
 
-	Config BuilderConfig
+	Config   BuilderConfig
+	Warnings []Warning
 }
 
 func (b *Builder) closeParagraph() {
+	b.lineBreak = false
 	if b.paragraphIsOpen {
+		b.closeLead()
 		b.paragraphIsOpen = false
 		b.append("\n</p>\n")
 	}
 }
 
 func (b *Builder) openParagraph() {
+	if b.defTag != "" || b.inline {
+		return
+	}
 	if !b.paragraphIsOpen && b.newSection {
 		b.paragraphIsOpen = true
 		b.newSection = false
 		b.append("<p class='indent'>\n")
+		if b.Config.LeadSentence {
+			b.leadIsOpen = true
+			b.append("<span class='lead'>")
+		}
 	} else if !b.paragraphIsOpen {
 		b.paragraphIsOpen = true
 		b.append("<p>\n")
+	} else if b.lineBreak {
+		b.lineBreak = false
+		b.append("<br/>\n")
+	}
+}
+
+func (b *Builder) closeLead() {
+	if b.leadIsOpen {
+		b.leadIsOpen = false
+		b.append("</span>")
+	}
+}
+
+var abbreviations = []string{"e.g.", "i.e.", "cf.", "etc.", "p.", "ex.", "M.", "Mr.", "Mme.", "Dr."}
+
+// sentenceEnd returns the index just past the punctuation ending the first
+// sentence of s, or -1 if the sentence goes on past s.
+func sentenceEnd(s string) int {
+	for i := 0; i < len(s)-1; i++ {
+		if !strings.ContainsRune(".!?", rune(s[i])) || (s[i+1] != ' ' && s[i+1] != '\n') {
+			continue
+		}
+
+		word := s[strings.LastIndexAny(s[:i], " \n")+1 : i+1]
+		isAbbreviation := false
+		for _, abbreviation := range abbreviations {
+			if word == abbreviation {
+				isAbbreviation = true
+			}
+		}
+		if !isAbbreviation {
+			return i + 1
+		}
+	}
+
+	return -1
+}
+
+// headingTag is the tag of a heading level, 1 for chapters, counted from
+// BaseHeadingLevel (2 by default) and kept within h1-h6.
+func (b *Builder) headingTag(level int) string {
+	base := b.Config.BaseHeadingLevel
+	if base == 0 {
+		base = 2
+	}
+	if base < 1 {
+		base = 1
+	}
+
+	n := base + level - 1
+	if n > 6 {
+		n = 6
+	}
+
+	return fmt.Sprintf("h%d", n)
+}
+
+func (b *Builder) headingClass() string {
+	if b.Config.NoHeadingHyphens {
+		return " class='no-hyphens'"
+	}
+
+	return ""
+}
+
+func (b *Builder) clearFloats() {
+	if b.floatIsOpen {
+		b.floatIsOpen = false
+		b.append("<div class='clear'></div>\n")
+	}
+}
+
+func (b *Builder) errorf(format string, args ...interface{}) {
+	if b.err == nil {
+		b.err = fmt.Errorf("line %d: %s", b.line, fmt.Sprintf(format, args...))
+	}
+}
+
+func (b *Builder) warnf(format string, args ...interface{}) {
+	b.Warnings = append(b.Warnings, Warning{Line: b.line, Message: fmt.Sprintf(format, args...)})
+}
+
+func (b *Builder) openBlock(name string, implicit bool, open string, close string) {
+	b.closeParagraph()
+	b.append(open)
+	b.blocks = append(b.blocks, block{name: name, close: close, implicit: implicit, line: b.line})
+}
+
+// unclosedBlock reports a block still open where a heading starts, since its
+// markup would otherwise swallow the heading. gmonly blocks may hold whole
+// sections, unless the heading opens an annex.
+func (b *Builder) unclosedBlock(where string, annex bool) bool {
+	for _, bl := range b.blocks {
+		if bl.implicit || (bl.name == "gmonly" && !annex) {
+			continue
+		}
+		b.errorf("%s: block opened on line %d is not closed %s", bl.name, bl.line, where)
+		return true
+	}
+
+	return false
+}
+
+func (b *Builder) closeBlock() block {
+	b.closeParagraph()
+	bl := b.blocks[len(b.blocks)-1]
+	b.blocks = b.blocks[:len(b.blocks)-1]
+	if bl.onClose != nil {
+		bl.onClose()
 	}
+	b.append(bl.close)
+
+	return bl
+}
+
+// endBlock closes the innermost block opened by a command, along with the
+// implicit blocks (faq entries, ...) nested in it. A non-empty name must be
+// the one of that block.
+func (b *Builder) endBlock(name string) {
+	if len(b.blocks) == 0 {
+		b.errorf("end: no open block")
+		return
+	}
+
+	if open := b.openCommandBlock(); name != "" && name != open {
+		b.errorf("end: %q closes the %q block", name, open)
+		return
+	}
+
+	for len(b.blocks) > 0 {
+		if !b.closeBlock().implicit {
+			return
+		}
+	}
+}
+
+// openCommandBlock is the name of the innermost block \end() closes.
+func (b *Builder) openCommandBlock() string {
+	for i := len(b.blocks) - 1; i >= 0; i-- {
+		if !b.blocks[i].implicit {
+			return b.blocks[i].name
+		}
+	}
+
+	return ""
+}
+
+func (b *Builder) inBlock(name string) bool {
+	return len(b.blocks) > 0 && b.blocks[len(b.blocks)-1].name == name
 }
 
 func (b *Builder) append(s string, args ...interface{}) {
@@ -126,205 +606,1628 @@ func (b *Builder) append(s string, args ...interface{}) {
 		return
 	}
 
-	_, err := b.content.WriteString(fmt.Sprintf(s, args...))
+	if len(args) > 0 {
+		s = fmt.Sprintf(s, args...)
+	}
+
+	_, err := io.WriteString(b.out, s)
 	b.err = err
 }
 
-func anchorName(s string) string {
-	s = strings.ToLower(s)
-	s = strings.Replace(s, " ", "-", -1)
+var (
+	textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "'", "&#39;", "\"", "&#34;")
+)
 
-	return s
+// escapeText makes user text safe as element content.
+func escapeText(s string) string {
+	return textEscaper.Replace(s)
 }
 
-func annexAnchorName(s string) string {
-	return fmt.Sprintf("annex-%s", anchorName(s))
+// escapeAttr makes user text safe inside a quoted attribute value.
+func escapeAttr(s string) string {
+	return attrEscaper.Replace(s)
 }
 
-func (b *Builder) handleItem(it item) {
-	if it.typ == itemNewLine {
-		b.closeParagraph()
-	} else if it.typ == itemListOpen {
-		b.closeParagraph()
-		b.append("<ol class='roman'>\n")
-	} else if it.typ == itemListClose {
-		b.append("</ol>\n\n")
-	} else if it.typ == itemStartListElement {
-		b.append("\n<li>\n")
-		b.openParagraph()
-	} else if it.typ == itemEndListElement {
-		b.closeParagraph()
-		b.append("\n</li>\n")
-	} else if it.typ == itemBold {
-		b.openParagraph()
-		b.append("<strong>%s</strong>", it.val)
-	} else if it.typ == itemCommand {
-		info := strings.Split(it.val, "|")
-		b.handleCommand(info[0], strings.Split(info[1], ","))
-	} else if it.typ == itemLink {
-		b.openParagraph()
-		info := strings.Split(it.val, "|")
-		text, link := info[0], info[1]
+const classNameChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-"
 
-		b.append("<a href='#%s'>%s</a>", anchorName(link), text)
-	} else if it.typ == itemEm {
-		b.openParagraph()
-		b.append("<em>%s</em>", it.val)
-	} else if it.typ == itemTableStart {
-		b.closeParagraph()
-		b.tableRowIndex = -1
-		b.tableTitle = it.val
-		b.append("<table>\n")
-	} else if it.typ == itemTableRow {
-		cells := strings.Split(it.val, "|")
-		if b.tableRowIndex == -1 {
-			b.append("<thead>\n")
-			b.append("<tr>\n")
-			b.append("<th colspan='%v'>%s</th>\n", len(cells), b.tableTitle)
-			b.append("</tr>\n")
-			b.append("</thead>\n")
-			b.append("<tbody>\n")
-		}
-		b.tableRowIndex += 1
-		b.append("<tr>\n")
-		b.append("<td class='head'>%s</td>\n", cells[0])
-		for _, cell := range cells[1:] {
-			if b.tableRowIndex == 0 {
-				b.append("<td class='head'>%s</td>\n", cell)
-			} else {
-				b.append("<td class='lead'>%s</td>\n", cell)
-			}
-		}
-		b.append("</tr>\n")
+// isClassName reports whether s can be used as a class attribute verbatim.
+func isClassName(s string) bool {
+	return s != "" && strings.Trim(s, classNameChars) == ""
+}
 
-	} else if it.typ == itemTableEnd {
-		b.append("</tbody>\n")
-		b.append("</table>\n")
-	} else {
-		if it.val != "" {
-			b.openParagraph()
-			b.append(it.val)
+var colorNames = map[string]bool{
+	"black": true, "white": true, "gray": true, "grey": true, "silver": true,
+	"red": true, "maroon": true, "orange": true, "yellow": true, "gold": true,
+	"olive": true, "lime": true, "green": true, "teal": true, "cyan": true,
+	"blue": true, "navy": true, "purple": true, "fuchsia": true, "magenta": true,
+	"pink": true, "brown": true,
+}
+
+// cssColor normalizes a hex value (with or without '#') or a known color name
+// into a CSS color, so it can't smuggle other declarations into a style.
+func cssColor(s string) (string, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if colorNames[s] {
+		return s, true
+	}
+
+	hex := strings.TrimPrefix(s, "#")
+	switch len(hex) {
+	case 3, 6, 8:
+		if strings.Trim(hex, "0123456789abcdef") == "" {
+			return "#" + hex, true
 		}
 	}
+
+	return "", false
 }
 
-func (b *Builder) handleCommand(name string, args []string) {
-	var classNames []string = []string{"illustration"}
+var anchorTransliterator = strings.NewReplacer(
+	"à", "a", "á", "a", "â", "a", "ä", "a", "ã", "a", "å", "a",
+	"ç", "c",
+	"è", "e", "é", "e", "ê", "e", "ë", "e",
+	"ì", "i", "í", "i", "î", "i", "ï", "i",
+	"ñ", "n",
+	"ò", "o", "ó", "o", "ô", "o", "ö", "o", "õ", "o",
+	"ù", "u", "ú", "u", "û", "u", "ü", "u",
+	"ý", "y", "ÿ", "y",
+	"æ", "ae", "œ", "oe", "ß", "ss",
+)
 
-	switch name {
-	case "color":
-		b.append("<span style='color: #%s'>%s</span>", strings.TrimSpace(args[1]), strings.TrimSpace(args[0]))
-	case "img":
-		b.closeParagraph()
-		if len(args) > 2 {
-			position := strings.TrimSpace(args[2])
-			switch position {
-			case "left":
-				classNames = append(classNames, "float-left")
-			case "right":
-				classNames = append(classNames, "float-right")
-			case "center":
-			}
-		}
+// anchorName turns a title into an id made of [a-z0-9-], so "Préparation du
+// Combat" and "Preparation du combat" name the same anchor.
+func anchorName(s string) string {
+	s = anchorTransliterator.Replace(strings.ToLower(s))
 
-		width := ""
-		height := ""
-		if len(args) > 3 {
-			size := strings.TrimSpace(args[3])
-			if size[0] == 'w' {
-				width = size[1:]
-			} else if size[0] == 'h' {
-				height = size[1:]
+	var name strings.Builder
+	hyphen := false
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			if hyphen && name.Len() > 0 {
+				name.WriteByte('-')
 			}
-		}
-
-		if width != "" {
-			b.append("<img class='%s' src='%s' alt='%s' width='%s'/>", strings.Join(classNames, " "), args[0], strings.TrimSpace(args[1]), width)
-		} else if height != "" {
-			b.append("<img class='%s' src='%s' alt='%s' height='%s'/>", strings.Join(classNames, " "), args[0], strings.TrimSpace(args[1]), height)
-		} else {
-			b.append("<img class='%s' src='%s' alt='%s' />", strings.Join(classNames, " "), args[0], strings.TrimSpace(args[1]))
+			hyphen = false
+			name.WriteRune(r)
+		case r == ' ' || r == '-':
+			hyphen = true
 		}
 	}
 
+	return name.String()
 }
 
-func (b *Builder) buildAnnex(annex Section) {
-	b.newSection = true
-	for _, it := range annex.Items {
-		b.handleItem(it)
-	}
+func annexAnchorName(s string) string {
+	return fmt.Sprintf("annex-%s", anchorName(s))
 }
 
-func (b *Builder) handleSection(section Section) {
-	b.newSection = true
-	b.append("<h3><a name='%s'></a>%s</h3>\n", anchorName(section.Title), section.Title)
-	for _, it := range section.Items {
-		b.handleItem(it)
+func (b *Builder) prefixAnchor(name string) string {
+	if b.Config.AnchorPrefix == "" {
+		return name
 	}
+
+	return fmt.Sprintf("%s-%s", b.Config.AnchorPrefix, name)
 }
 
-func (b *Builder) buildTableOfContents(document Document) {
-	b.append("<div id='summary'>\n<h3>Table des matières</h3>\n")
-	b.append("<ol>\n")
-	for _, section := range document.Sections {
-		b.append("<li><a href='#%s'>%s</a></li>\n", anchorName(section.Title), section.Title)
+func (b *Builder) anchor(s string) string {
+	return b.prefixAnchor(anchorName(s))
+}
+
+func (b *Builder) annexAnchor(s string) string {
+	return b.prefixAnchor(annexAnchorName(s))
+}
+
+func (b *Builder) dataLabel(column int) string {
+	if !b.Config.TableDataLabels || b.tableRowIndex == 0 || column >= len(b.tableHeaders) {
+		return ""
 	}
-	b.append("</ol>\n")
 
-	b.append("<ol>\n")
-	for chapterIndex, chapter := range document.Chapters {
-		b.append("<li><strong>%s</strong> - <a href='#%s'>%s</a></li>\n", toRoman(chapterIndex), anchorName(chapter.Title), chapter.Title)
-		b.append("<ol class='roman'>\n")
-		for _, section := range chapter.Sections {
-			b.append("<li><a href='#%s'>%s</a></li>\n", anchorName(section.Title), section.Title)
-		}
-		b.append("</ol>\n")
+	return fmt.Sprintf(" data-label='%s'", escapeAttr(strings.TrimSpace(cellText(b.tableHeaders[column]))))
+}
+
+// splitFlags separates a trailing {flag,flag} hint from s.
+func splitFlags(s string) (string, []string) {
+	s = strings.TrimSpace(s)
+	start := strings.LastIndex(s, "{")
+	if !strings.HasSuffix(s, "}") || start == -1 {
+		return s, nil
 	}
-	b.append("</ol>\n")
 
-	b.append("<ol>\n")
-	for annexIndex, annex := range document.Annexes {
-		b.append("<li><strong>Annexe %s</strong>: <a href='#%s'>%s</a></li>\n", toAnnex(annexIndex), annexAnchorName(annex.Title), annex.Title)
+	flags := []string{}
+	for _, flag := range strings.Split(s[start+1:len(s)-1], ",") {
+		flags = append(flags, strings.TrimSpace(flag))
 	}
-	b.append("</ol>\n")
 
-	b.append("</div>\n")
+	return strings.TrimSpace(s[:start]), flags
 }
 
-func (b *Builder) Build(document Document) (string, error) {
-	b.content.Reset()
-	b.paragraphIsOpen = false
+// openTable is deferred to the first row, once the column count is known.
+func (b *Builder) openTable(columns int) {
+	if b.Config.CompactPairTables && columns == 2 {
+		b.append("<table class='compact' aria-label='%s'>\n", escapeAttr(b.tableTitle))
+		b.append("<tbody>\n")
+		return
+	}
 
-	if b.Config.TableOfContents {
-		b.buildTableOfContents(document)
+	if b.tableCaptionOnly {
+		b.append("<table aria-label='%s'>\n", escapeAttr(b.tableTitle))
+		b.append("<tbody>\n")
+		return
 	}
 
-	for _, section := range document.Sections {
-		b.handleSection(section)
+	if b.Config.TableCaption {
+		b.append("<table>\n")
+		b.append("<caption>%s</caption>\n", escapeText(b.tableTitle))
+		b.append("<tbody>\n")
+		return
 	}
 
-	for chapterIndex, chapter := range document.Chapters {
-		b.newSection = true
-		b.append("<h2><a id='%s'></a>%s - %s</h2>\n", anchorName(chapter.Title), toRoman(chapterIndex), chapter.Title)
-		for _, it := range chapter.Items {
-			b.handleItem(it)
-		}
+	b.append("<table>\n")
+	b.append("<thead>\n")
+	b.append("<tr>\n")
+	b.append("<th colspan='%v'>%s</th>\n", columns, escapeText(b.tableTitle))
+	b.append("</tr>\n")
+	b.append("</thead>\n")
+	b.append("<tbody>\n")
+}
 
-		for _, section := range chapter.Sections {
-			b.handleSection(section)
+// isExternalLink reports whether a link target is an URL rather than the
+// title of a heading.
+func isExternalLink(link string) bool {
+	for _, prefix := range []string{"http://", "https://", "mailto:", "/"} {
+		if strings.HasPrefix(link, prefix) {
+			return true
 		}
 	}
 
-	for annexIndex, annex := range document.Annexes {
-		b.append("<div class='annex'>\n")
-		b.append("<h2><a name='%s'></a>Annexe %v: %s</h2>\n", annexAnchorName(annex.Title), toAnnex(annexIndex), annex.Title)
-		b.newSection = true
-		for _, it := range annex.Items {
-			b.handleItem(it)
-		}
-		b.append("</div>\n")
+	return false
+}
+
+// HTMLRenderer is the Renderer behind Builder.Build. Given to Render on its
+// own, it writes to W, or only collects the warnings when W is nil.
+type HTMLRenderer struct {
+	*Builder
+	W io.Writer
+}
+
+func (b HTMLRenderer) setLine(line int) {
+	b.line = line
+}
+
+func (b HTMLRenderer) NewLine() {
+	// read-aloud text keeps single line breaks, blank lines still
+	// separate paragraphs.
+	if b.inBlock("readaloud") && b.paragraphIsOpen && !b.lineBreak {
+		b.lineBreak = true
+		return
+	}
+	b.closeParagraph()
+}
+
+func (b HTMLRenderer) ListOpen(style string) {
+	b.closeParagraph()
+	if !b.Config.IndentListItems {
+		b.newSection = false
+	}
+	if style == "decimal" {
+		b.listTags = append(b.listTags, "ol")
+		b.append("<ol class='decimal'>\n")
+	} else if b.Config.DefaultListType == "ul" {
+		b.listTags = append(b.listTags, "ul")
+		b.append("<ul>\n")
+	} else {
+		b.listTags = append(b.listTags, "ol")
+		b.append("<ol class='roman'>\n")
+	}
+}
+
+func (b HTMLRenderer) ListClose() {
+	if len(b.listTags) == 0 {
+		b.errorf("list: closing a list that is not open")
+		return
+	}
+	tag := b.listTags[len(b.listTags)-1]
+	b.listTags = b.listTags[:len(b.listTags)-1]
+	b.append("</%s>\n\n", tag)
+}
+
+func (b HTMLRenderer) ListItemOpen() {
+	b.append("\n<li>\n")
+	b.openParagraph()
+}
+
+func (b HTMLRenderer) ListItemClose() {
+	b.closeParagraph()
+	b.append("\n</li>\n")
+}
+
+func (b HTMLRenderer) Bold(s string) {
+	b.openParagraph()
+	b.append("<strong>%s</strong>", escapeText(s))
+}
+
+func (b HTMLRenderer) Italic(s string) {
+	b.openParagraph()
+	b.append("<i>%s</i>", escapeText(s))
+}
+
+func (b HTMLRenderer) Command(name string, args []string) {
+	b.handleCommand(name, args)
+}
+
+func (b HTMLRenderer) Link(text string, link string) {
+	b.openParagraph()
+
+	attrs := ""
+	link, flags := splitFlags(link)
+	for _, flag := range flags {
+		if flag == "blank" {
+			attrs = " target='_blank' rel='noopener'"
+		}
+	}
+
+	if isExternalLink(link) {
+		b.append("<a href='%s'%s>%s</a>", escapeAttr(link), attrs, escapeText(text))
+	} else {
+		anchor := b.anchor(link)
+		if t, ok := b.findTarget(link); ok {
+			anchor = t.anchor
+		} else {
+			b.warnf("link: unknown target %q", link)
+		}
+		b.append("<a href='#%s'%s>%s</a>", escapeAttr(anchor), attrs, escapeText(text))
+	}
+}
+
+func (b HTMLRenderer) Em(s string) {
+	b.openParagraph()
+	b.append("<em>%s</em>", escapeText(s))
+}
+
+func (b HTMLRenderer) Sup(s string) {
+	b.openParagraph()
+	b.append("<sup>%s</sup>", escapeText(s))
+}
+
+func (b HTMLRenderer) Sub(s string) {
+	b.openParagraph()
+	b.append("<sub>%s</sub>", escapeText(s))
+}
+
+func (b HTMLRenderer) Mark(s string) {
+	b.openParagraph()
+	b.append("<mark>%s</mark>", escapeText(s))
+}
+
+func (b HTMLRenderer) Strike(s string) {
+	b.openParagraph()
+	b.append("<del>%s</del>", escapeText(s))
+}
+
+func (b HTMLRenderer) Code(s string) {
+	b.openParagraph()
+	b.append("<code>%s</code>", escapeText(s))
+}
+
+func (b HTMLRenderer) CodeBlock(s string) {
+	b.closeParagraph()
+	b.append("<pre><code>%s</code></pre>\n", escapeText(s))
+}
+
+func (b HTMLRenderer) Rule() {
+	b.closeParagraph()
+	b.append("<hr/>\n")
+}
+
+func (b HTMLRenderer) DefListOpen() {
+	b.closeParagraph()
+	b.newSection = false
+	b.append("<dl>\n")
+}
+
+// closeDefinition ends the open term or definition.
+func (b *Builder) closeDefinition() {
+	if b.defTag != "" {
+		b.append("</%s>\n", b.defTag)
+		b.defTag = ""
+	}
+}
+
+func (b HTMLRenderer) DefTerm() {
+	b.closeDefinition()
+	b.defTag = "dt"
+	b.append("<dt>")
+}
+
+func (b HTMLRenderer) DefDesc() {
+	b.closeDefinition()
+	b.defTag = "dd"
+	b.append("<dd>")
+}
+
+func (b HTMLRenderer) DefListClose() {
+	b.closeDefinition()
+	b.append("</dl>\n")
+}
+
+func (b HTMLRenderer) QuoteOpen() {
+	b.closeParagraph()
+	b.newSection = false
+	b.append("<blockquote>\n")
+}
+
+func (b HTMLRenderer) QuoteClose() {
+	b.closeParagraph()
+	b.append("</blockquote>\n")
+}
+
+func (b HTMLRenderer) TableOpen(title string) {
+	b.closeParagraph()
+	b.newSection = false
+	b.tableRowIndex = -1
+	b.tableAligns = nil
+	b.tableRagged = false
+	b.tableTitle, b.tableCaptionOnly = title, false
+	caption, flags := splitFlags(title)
+	for _, flag := range flags {
+		if flag == "caption-only" {
+			b.tableTitle, b.tableCaptionOnly = caption, true
+		}
+	}
+}
+
+// cellHTML renders the inline markup of a table cell.
+func (b *Builder) cellHTML(cell string) string {
+	items, err := cellItems(cell)
+	if err != nil {
+		if lexErr, ok := err.(LexError); ok {
+			b.errorf("table: %s in cell %q", lexErr.Message, cell)
+		} else {
+			b.errorf("table: %v", err)
+		}
+		return ""
+	}
+
+	var html strings.Builder
+	out := b.out
+	b.out, b.inline = &html, true
+	for _, it := range items {
+		if name := commandName(it); it.typ == ItemCommand && (blockCommands[name] || name == "end") {
+			b.errorf("table: \\%s() cannot be used in a cell", name)
+			break
+		}
+		renderItem(HTMLRenderer{Builder: b}, it)
+	}
+	b.out, b.inline = out, false
+
+	return html.String()
+}
+
+func (b HTMLRenderer) TableAlign(aligns []string) {
+	b.tableAligns = aligns
+}
+
+func (b *Builder) cellAlign(column int) string {
+	if column >= len(b.tableAligns) || b.tableAligns[column] == "" {
+		return ""
+	}
+
+	return fmt.Sprintf(" style='text-align: %s'", b.tableAligns[column])
+}
+
+func (b HTMLRenderer) TableRow(cells []string) {
+	if b.tableRowIndex == -1 {
+		b.openTable(len(cells))
+	}
+	b.tableRowIndex += 1
+	if b.tableRowIndex == 0 {
+		b.tableHeaders = cells
+	} else if len(cells) != len(b.tableHeaders) && !b.tableRagged {
+		b.tableRagged = true
+		title, _ := splitFlags(b.tableTitle)
+		b.warnf("table %q: row of %d cells, expected %d", title, len(cells), len(b.tableHeaders))
+	}
+	b.append("<tr>\n")
+	b.append("<td class='head'%s%s>%s</td>\n", b.dataLabel(0), b.cellAlign(0), b.cellHTML(cells[0]))
+	for i, cell := range cells[1:] {
+		if b.tableRowIndex == 0 {
+			b.append("<td class='head'%s>%s</td>\n", b.cellAlign(i+1), b.cellHTML(cell))
+		} else {
+			b.append("<td class='lead'%s%s>%s</td>\n", b.dataLabel(i+1), b.cellAlign(i+1), b.cellHTML(cell))
+		}
+	}
+	b.append("</tr>\n")
+}
+
+func (b HTMLRenderer) TableClose() {
+	if b.tableRowIndex == -1 {
+		title, _ := splitFlags(b.tableTitle)
+		b.warnf("table %q: no rows", title)
+		b.openTable(1)
+	}
+	b.append("</tbody>\n")
+	b.append("</table>\n")
+}
+
+func (b HTMLRenderer) Text(s string) {
+	if s != "" {
+		b.openParagraph()
+		if end := sentenceEnd(s); b.leadIsOpen && end != -1 {
+			b.append(escapeText(s[:end]))
+			b.closeLead()
+			b.append(escapeText(s[end:]))
+		} else {
+			b.append(escapeText(s))
+		}
+	}
+}
+
+func (b *Builder) handleCommand(name string, args []string) {
+	var classNames []string = []string{"illustration"}
+	if b.Config.IllustrationClass != "" {
+		classNames = strings.Fields(b.Config.IllustrationClass)
+	}
+
+	if command, ok := b.Config.Commands[name]; ok {
+		html, err := command(args)
+		if err != nil {
+			b.errorf("%s: %v", name, err)
+			return
+		}
+		b.openParagraph()
+		b.append("%s", html)
+		return
+	}
+
+	switch name {
+	case "begin":
+		b.handleBegin(args)
+	case "end":
+		name := ""
+		if len(args) > 0 {
+			name = args[0]
+		}
+		b.endBlock(name)
+	case "gmonly":
+		b.openBlock("gmonly", false, "<div class='gm-only'>\n", "</div>\n")
+	case "readaloud":
+		b.openBlock("readaloud", false, "<div class='read-aloud'>\n", "</div>\n")
+	case "faq":
+		b.openBlock("faq", false, "<div class='faq'>\n", "</div>\n")
+	case "q":
+		if b.inBlock("faq-answer") {
+			b.closeBlock()
+		}
+		if b.inBlock("faq-entry") {
+			b.closeBlock()
+		}
+		if !b.inBlock("faq") {
+			b.errorf("q: outside of a faq block")
+			return
+		}
+		b.openBlock("faq-entry", true, fmt.Sprintf("<details>\n<summary>%s</summary>\n", escapeText(strings.Join(args, ", "))), "</details>\n")
+	case "a":
+		if !b.inBlock("faq-entry") {
+			b.errorf("a: not preceded by a question")
+			return
+		}
+		b.openBlock("faq-answer", true, "<div class='answer'>\n", "</div>\n")
+		if answer := strings.Join(args, ", "); answer != "" {
+			b.openParagraph()
+			b.append(escapeText(answer))
+		}
+	case "rtable":
+		b.openRandomTable(args)
+	case "roll":
+		b.handleRoll(args)
+	case "tokens":
+		b.openTokens(args)
+	case "token":
+		if !b.inBlock("tokens") {
+			b.errorf("token: outside of a tokens block")
+			return
+		}
+		if len(args) != 2 {
+			b.errorf("token: expected 2 args (front, back), got %d", len(args))
+			return
+		}
+		b.tokens = append(b.tokens, [2]string{args[0], args[1]})
+	case "shortcuts":
+		b.openBlock("shortcuts", false, "<table class='shortcuts'>\n<tbody>\n", "</tbody>\n</table>\n")
+	case "shortcut":
+		b.handleShortcut(args)
+	case "cr":
+		rating := strings.Join(args, ", ")
+		if !validChallengeRating(rating) {
+			b.warnf("cr: invalid challenge rating %q", rating)
+		}
+		b.openParagraph()
+		b.append("<span class='cr' data-cr='%s'>%s</span>", escapeAttr(rating), escapeText(rating))
+	case "media":
+		b.handleMedia(args)
+	case "video":
+		b.handleVideo(args)
+	case "flow":
+		b.openFlow()
+	case "node":
+		if !b.inBlock("flow") {
+			b.errorf("node: outside of a flow block")
+			return
+		}
+		if len(args) < 2 {
+			b.errorf("node: expected 2 args (id, text), got %d", len(args))
+			return
+		}
+		for _, node := range b.flow.nodes {
+			if node.id == args[0] {
+				b.errorf("node: %q is already defined", args[0])
+				return
+			}
+		}
+		b.flow.nodes = append(b.flow.nodes, flowNode{id: args[0], text: strings.Join(args[1:], ", ")})
+	case "edge":
+		if !b.inBlock("flow") {
+			b.errorf("edge: outside of a flow block")
+			return
+		}
+		if len(args) < 2 {
+			b.errorf("edge: expected at least 2 args (from, to, label), got %d", len(args))
+			return
+		}
+		e := flowEdge{from: args[0], to: args[1], line: b.line}
+		if len(args) > 2 {
+			e.label = strings.Join(args[2:], ", ")
+		}
+		b.flow.edges = append(b.flow.edges, e)
+	case "bar":
+		b.handleBar(args)
+	case "erratanote":
+		note := strings.Join(args, ", ")
+		b.errata = append(b.errata, note)
+		b.openParagraph()
+		b.append("<span class='errata' id='%s' tabindex='0' title='%s'>†<span class='errata-text'>%s</span></span>", b.prefixAnchor(fmt.Sprintf("errata-%d", len(b.errata))), escapeAttr(note), escapeText(note))
+	case "seealso":
+		b.handleSeeAlso(args)
+	case "attribution":
+		b.addAttribution(strings.Join(args, ", "))
+	case "color":
+		if len(args) < 2 || len(args) > 3 {
+			b.errorf("color: expected 2 or 3 args (text, color, background), got %d", len(args))
+			return
+		}
+		style := ""
+		for i, property := range []string{"color", "background-color"} {
+			if i+1 >= len(args) {
+				break
+			}
+			color, ok := cssColor(args[i+1])
+			if !ok {
+				b.errorf("color: invalid %s %q, expected 3, 6 or 8 hex digits or a color name", property, args[i+1])
+				return
+			}
+			style += fmt.Sprintf("%s: %s; ", property, color)
+		}
+		b.openParagraph()
+		if b.Config.Grayscale {
+			b.append("<strong class='color'>%s</strong>", escapeText(args[0]))
+			return
+		}
+		b.append("<span style='%s'>%s</span>", strings.TrimSuffix(style, "; "), escapeText(args[0]))
+	case "anchor":
+		if len(args) != 1 {
+			b.errorf("anchor: expected 1 arg (name), got %d", len(args))
+			return
+		}
+		if args[0] == "" || anchorName(args[0]) != args[0] {
+			b.errorf("anchor: invalid name %q, expected lowercase letters, digits and hyphens", args[0])
+			return
+		}
+		t, ok := b.targets[args[0]]
+		if !ok || !t.inline {
+			b.errorf("anchor: %q is already used by another target", args[0])
+			return
+		}
+		if t.claimed {
+			b.errorf("anchor: %q is already defined", args[0])
+			return
+		}
+		t.claimed = true
+		b.targets[args[0]] = t
+		b.append("<a id='%s'></a>", t.anchor)
+	case "html":
+		if !b.Config.AllowRawHTML {
+			b.errorf("html: raw HTML requires AllowRawHTML")
+			return
+		}
+		b.append("%s", strings.Join(args, ", "))
+	case "span":
+		if len(args) != 2 {
+			b.errorf("span: expected 2 args (text, class), got %d", len(args))
+			return
+		}
+		if !isClassName(args[1]) {
+			b.errorf("span: invalid class name %q", args[1])
+			return
+		}
+		b.openParagraph()
+		b.append("<span class='%s'>%s</span>", args[1], escapeText(args[0]))
+	case "img":
+		if len(args) < 2 {
+			b.errorf("img: expected at least 2 args (src, alt), got %d", len(args))
+			return
+		}
+		if args[0] == "" {
+			b.errorf("img: missing src")
+			return
+		}
+		b.closeParagraph()
+		if len(args) > 2 {
+			switch args[2] {
+			case "left":
+				classNames = append(classNames, "float-left")
+				b.floatIsOpen = true
+			case "right":
+				classNames = append(classNames, "float-right")
+				b.floatIsOpen = true
+			case "center":
+			}
+		}
+
+		width := ""
+		height := ""
+		if len(args) > 3 {
+			width, height = parseImageSize(args[3])
+		}
+
+		attrs := ""
+		if width != "" {
+			attrs += fmt.Sprintf(" width='%s'", escapeAttr(width))
+		}
+		if height != "" {
+			attrs += fmt.Sprintf(" height='%s'", escapeAttr(height))
+		}
+		if len(args) > 4 && args[4] != "" {
+			attrs += fmt.Sprintf(" srcset='%s'", escapeAttr(args[4]))
+		}
+		attrs += b.lazyImage()
+
+		if attrs != "" {
+			b.append("<img class='%s' src='%s' alt='%s'%s/>", strings.Join(classNames, " "), escapeAttr(args[0]), escapeAttr(args[1]), attrs)
+		} else {
+			b.append("<img class='%s' src='%s' alt='%s' />", strings.Join(classNames, " "), escapeAttr(args[0]), escapeAttr(args[1]))
+		}
+	case "figure":
+		b.handleFigure(args)
+	case "statblock":
+		b.handleStatBlock(args)
+	case "dice":
+		notation := strings.Join(args, ", ")
+		if err := parseDice(notation); err != nil {
+			b.errorf("dice: %v", err)
+			return
+		}
+		b.openParagraph()
+		b.append("<span class='dice' data-dice='%s'>%s</span>", escapeAttr(notation), escapeText(notation))
+	default:
+		if b.Config.StrictCommands {
+			b.errorf("unknown command %q", name)
+			return
+		}
+		b.warnf("unknown command %q", name)
+		b.openParagraph()
+		b.append(escapeText(fmt.Sprintf("\\%s(%s)", name, strings.Join(args, ", "))))
+	}
+
+}
+
+func (b *Builder) openRandomTable(args []string) {
+	if len(args) == 0 {
+		b.errorf("rtable: expected a die")
+		return
+	}
+
+	faces, err := parseDie(args[0])
+	if err != nil {
+		b.errorf("rtable: %v", err)
+		return
+	}
+
+	die := strings.TrimPrefix(args[0], "die=")
+	table := &randomTable{die: die, faces: faces, covered: make([]int, faces+1), line: b.line}
+
+	open := "<table class='random-table'>\n<thead>\n"
+	if len(args) > 1 {
+		open += fmt.Sprintf("<tr>\n<th colspan='3'>%s</th>\n</tr>\n", escapeText(strings.Join(args[1:], ", ")))
+	}
+	open += fmt.Sprintf("<tr>\n<th>%s</th>\n<th></th>\n<th>%%</th>\n</tr>\n</thead>\n<tbody>\n", escapeText(die))
+
+	b.openBlock("rtable", false, open, "</tbody>\n</table>\n")
+	b.blocks[len(b.blocks)-1].onClose = func() {
+		if gaps := table.gaps(); len(gaps) > 0 {
+			b.Warnings = append(b.Warnings, Warning{
+				Line:    table.line,
+				Message: fmt.Sprintf("rtable: %s does not cover %s", table.die, formatRanges(gaps)),
+			})
+		}
+		b.randomTable = nil
+	}
+	b.randomTable = table
+}
+
+func (b *Builder) handleRoll(args []string) {
+	if !b.inBlock("rtable") {
+		b.errorf("roll: outside of a rtable block")
+		return
+	}
+
+	if len(args) < 2 {
+		b.errorf("roll: expected 2 args (range, result), got %d", len(args))
+		return
+	}
+
+	low, high, err := b.randomTable.parseRange(args[0])
+	if err != nil {
+		b.errorf("roll: %v", err)
+		return
+	}
+
+	for _, problem := range b.randomTable.cover(low, high) {
+		b.warnf("roll: %s", problem)
+	}
+
+	b.append("<tr>\n")
+	b.append("<td class='head'>%s</td>\n", escapeText(args[0]))
+	b.append("<td class='lead'>%s</td>\n", escapeText(strings.Join(args[1:], ", ")))
+	b.append("<td class='weight'>%d%%</td>\n", (high-low+1)*100/b.randomTable.faces)
+	b.append("</tr>\n")
+}
+
+func (b *Builder) handleShortcut(args []string) {
+	if !b.inBlock("shortcuts") {
+		b.errorf("shortcut: outside of a shortcuts block")
+		return
+	}
+
+	if len(args) < 2 {
+		b.errorf("shortcut: expected 2 args (keys, action), got %d", len(args))
+		return
+	}
+
+	keys := []string{}
+	for _, key := range strings.Split(args[0], "+") {
+		keys = append(keys, fmt.Sprintf("<kbd>%s</kbd>", escapeText(strings.TrimSpace(key))))
+	}
+
+	b.append("<tr>\n")
+	b.append("<td class='head'>%s</td>\n", strings.Join(keys, "+"))
+	b.append("<td class='lead'>%s</td>\n", escapeText(strings.Join(args[1:], ", ")))
+	b.append("</tr>\n")
+}
+
+// validChallengeRating accepts whole ratings and the 1/8, 1/4 and 1/2
+// fractions used for the weakest creatures.
+func validChallengeRating(s string) bool {
+	switch s {
+	case "1/8", "1/4", "1/2":
+		return true
+	}
+
+	n, err := strconv.Atoi(s)
+
+	return err == nil && n >= 0 && n <= 30
+}
+
+var videoTypes = map[string]string{
+	".mp4":  "video/mp4",
+	".webm": "video/webm",
+	".ogv":  "video/ogg",
+}
+
+func (b *Builder) handleVideo(args []string) {
+	if len(args) == 0 || len(args) > 2 {
+		b.errorf("video: expected 1 or 2 args (src, poster), got %d", len(args))
+		return
+	}
+	if args[0] == "" {
+		b.errorf("video: missing src")
+		return
+	}
+
+	b.closeParagraph()
+	if len(args) > 1 && args[1] != "" {
+		b.append("<video controls poster='%s'>\n", escapeAttr(args[1]))
+	} else {
+		b.append("<video controls>\n")
+	}
+	if videoType, ok := videoTypes[strings.ToLower(path.Ext(args[0]))]; ok {
+		b.append("<source src='%s' type='%s'>\n", escapeAttr(args[0]), videoType)
+	} else {
+		b.append("<source src='%s'>\n", escapeAttr(args[0]))
+	}
+	b.append("</video>\n")
+}
+
+func (b *Builder) handleMedia(args []string) {
+	if !b.Config.AllowRawHTML {
+		b.errorf("media: embeds require AllowRawHTML")
+		return
+	}
+
+	if len(args) != 2 {
+		b.errorf("media: expected 2 args (url, ratio), got %d", len(args))
+		return
+	}
+
+	ratio := strings.SplitN(args[1], ":", 2)
+	if len(ratio) != 2 {
+		b.errorf("media: invalid ratio %q, expected width:height", args[1])
+		return
+	}
+	for _, side := range ratio {
+		if n, err := strconv.Atoi(side); err != nil || n < 1 {
+			b.errorf("media: invalid ratio %q, expected width:height", args[1])
+			return
+		}
+	}
+
+	b.closeParagraph()
+	b.append("<div class='media-embed' style='aspect-ratio:%s/%s'>\n", ratio[0], ratio[1])
+	b.append("<iframe src='%s' allowfullscreen></iframe>\n", escapeAttr(args[0]))
+	b.append("</div>\n")
+}
+
+type flowNode struct {
+	id   string
+	text string
+}
+
+type flowEdge struct {
+	from  string
+	to    string
+	label string
+	line  int
+}
+
+type flow struct {
+	nodes []flowNode
+	edges []flowEdge
+}
+
+func (b *Builder) openFlow() {
+	b.flowCount++
+	b.flow = &flow{}
+	b.openBlock("flow", false, "<figure class='flow'>\n", "</figure>\n")
+	b.blocks[len(b.blocks)-1].onClose = func() {
+		b.buildFlow()
+		b.flow = nil
+	}
+}
+
+func (b *Builder) flowNodeAnchor(id string) string {
+	return b.prefixAnchor(fmt.Sprintf("flow-%d-%s", b.flowCount, id))
+}
+
+// buildFlow renders the decision tree as nested lists: every node lists its
+// outgoing edges as links to the target nodes.
+func (b *Builder) buildFlow() {
+	nodes := map[string]flowNode{}
+	for _, node := range b.flow.nodes {
+		nodes[node.id] = node
+	}
+
+	for _, e := range b.flow.edges {
+		for _, id := range []string{e.from, e.to} {
+			if _, ok := nodes[id]; !ok {
+				b.line = e.line
+				b.errorf("edge: unknown node %q", id)
+				return
+			}
+		}
+	}
+
+	b.append("<ol class='flow-nodes'>\n")
+	for _, node := range b.flow.nodes {
+		b.append("<li class='flow-node' id='%s'><span class='flow-text'>%s</span>\n", escapeAttr(b.flowNodeAnchor(node.id)), escapeText(node.text))
+		edges := []flowEdge{}
+		for _, e := range b.flow.edges {
+			if e.from == node.id {
+				edges = append(edges, e)
+			}
+		}
+		if len(edges) > 0 {
+			b.append("<ul class='flow-edges'>\n")
+			for _, e := range edges {
+				b.append("<li><span class='flow-label'>%s</span> → <a href='#%s'>%s</a></li>\n", escapeText(e.label), escapeAttr(b.flowNodeAnchor(e.to)), escapeText(nodes[e.to].text))
+			}
+			b.append("</ul>\n")
+		}
+		b.append("</li>\n")
+	}
+	b.append("</ol>\n")
+}
+
+func (b *Builder) handleBar(args []string) {
+	if len(args) != 3 {
+		b.errorf("bar: expected 3 args (label, value, max), got %d", len(args))
+		return
+	}
+
+	label := args[0]
+	value, err := strconv.ParseFloat(args[1], 64)
+	if err != nil {
+		b.errorf("bar: value %q is not a number", args[1])
+		return
+	}
+	max, err := strconv.ParseFloat(args[2], 64)
+	if err != nil {
+		b.errorf("bar: max %q is not a number", args[2])
+		return
+	}
+
+	if max <= 0 || value < 0 || value > max {
+		b.errorf("bar: value %v must be between 0 and max %v", value, max)
+		return
+	}
+
+	b.openParagraph()
+	b.append("<span class='tracker'>%s <progress value='%v' max='%v' aria-label='%s'>%v/%v</progress></span>", escapeText(label), value, max, escapeAttr(label), value, max)
+}
+
+// maxTokenColumns is more tokens than fit across a printed page.
+const maxTokenColumns = 12
+
+func (b *Builder) openTokens(args []string) {
+	columns := 4
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			b.errorf("tokens: invalid column count %q", args[0])
+			return
+		}
+		if n > maxTokenColumns {
+			b.errorf("tokens: column count %d is more than %d", n, maxTokenColumns)
+			return
+		}
+		columns = n
+	}
+
+	b.tokens = nil
+	b.openBlock("tokens", false, fmt.Sprintf("<div class='token-sheet' style='--columns: %d'>\n", columns), "</div>\n")
+	b.blocks[len(b.blocks)-1].onClose = func() {
+		b.buildTokens(columns)
+	}
+}
+
+// buildTokens lays out the fronts, then the backs with each row mirrored so
+// that both sides line up once printed duplex.
+func (b *Builder) buildTokens(columns int) {
+	b.append("<div class='tokens-front'>\n")
+	for _, token := range b.tokens {
+		b.append("<div class='token'>%s</div>\n", escapeText(token[0]))
+	}
+	b.append("</div>\n")
+
+	b.append("<div class='tokens-back'>\n")
+	for row := 0; row < len(b.tokens); row += columns {
+		for column := columns - 1; column >= 0; column-- {
+			if row+column < len(b.tokens) {
+				b.append("<div class='token'>%s</div>\n", escapeText(b.tokens[row+column][1]))
+			} else {
+				b.append("<div class='token empty'></div>\n")
+			}
+		}
+	}
+	b.append("</div>\n")
+
+	b.tokens = nil
+}
+
+func (b *Builder) addAttribution(text string) {
+	for _, attribution := range b.attributions {
+		if attribution == text {
+			return
+		}
+	}
+
+	b.attributions = append(b.attributions, text)
+}
+
+func (b *Builder) buildErrataIndex() {
+	tag := b.headingTag(1)
+	b.append("<div class='errata-index'>\n<%s%s>Errata</%s>\n<ol>\n", tag, b.headingClass(), tag)
+	for i, note := range b.errata {
+		b.append("<li><a href='#%s'>%s</a></li>\n", b.prefixAnchor(fmt.Sprintf("errata-%d", i+1)), escapeText(note))
+	}
+	b.append("</ol>\n</div>\n")
+}
+
+func (b *Builder) buildAttributions() {
+	tag := b.headingTag(1)
+	b.append("<div class='license'>\n<%s%s>%s</%s>\n<ul>\n", tag, b.headingClass(), escapeText(b.labels().Licenses), tag)
+	for _, attribution := range b.attributions {
+		b.append("<li>%s</li>\n", escapeText(attribution))
+	}
+	b.append("</ul>\n</div>\n")
+}
+
+type target struct {
+	title   string
+	anchor  string
+	inline  bool // set by \anchor() rather than a heading
+	claimed bool // set once an \anchor() occurrence has been output
+}
+
+// collectTargets indexes every heading by the name links use to refer to it.
+// Headings sharing a title get -2, -3, ... suffixed anchors, and links to
+// that title go to the first of them. \anchor() commands come last and never
+// take over a heading's anchor.
+func (b *Builder) collectTargets(document Document) {
+	b.targets = map[string]target{}
+	b.headings = headingAnchors{}
+	used := map[string]bool{}
+	add := func(name string, title string, anchor string) {
+		unique := anchor
+		for n := 2; used[unique]; n++ {
+			unique = fmt.Sprintf("%s-%d", anchor, n)
+		}
+		used[unique] = true
+		b.headings.anchors = append(b.headings.anchors, unique)
+		if _, ok := b.targets[name]; !ok {
+			b.targets[name] = target{title: title, anchor: unique}
+		}
+	}
+	addSections := func(sections []Section) {
+		for _, section := range sections {
+			add(anchorName(section.Title), section.Title, b.anchor(section.Title))
+			for _, sub := range section.SubSections {
+				add(anchorName(sub.Title), sub.Title, b.anchor(sub.Title))
+			}
+		}
+	}
+
+	addSections(document.Sections)
+	for _, chapter := range document.Chapters {
+		add(anchorName(chapter.Title), chapter.Title, b.anchor(chapter.Title))
+		addSections(chapter.Sections)
+	}
+	for _, annex := range document.Annexes {
+		add(annexAnchorName(annex.Title), annex.Title, b.annexAnchor(annex.Title))
+		addSections(annex.Sections)
+	}
+
+	addAnchors := func(items []Item) {
+		for _, name := range anchorNames(items) {
+			anchor := b.prefixAnchor(name)
+			if _, ok := b.targets[name]; ok || used[anchor] {
+				continue
+			}
+			used[anchor] = true
+			b.targets[name] = target{title: name, anchor: anchor, inline: true}
+		}
+	}
+	var addSectionAnchors func(sections []Section)
+	addSectionAnchors = func(sections []Section) {
+		for _, section := range sections {
+			addAnchors(section.Items)
+			addSectionAnchors(section.SubSections)
+		}
+	}
+
+	addAnchors(document.Items)
+	addSectionAnchors(document.Sections)
+	for _, chapter := range document.Chapters {
+		addAnchors(chapter.Items)
+		addSectionAnchors(chapter.Sections)
+	}
+	for _, annex := range document.Annexes {
+		addAnchors(annex.Items)
+		addSectionAnchors(annex.Sections)
+	}
+}
+
+// findTarget looks up what a link points to: a heading or an \anchor() by its
+// name, else an annex by its title.
+func (b *Builder) findTarget(name string) (target, bool) {
+	if t, ok := b.targets[anchorName(name)]; ok {
+		return t, true
+	}
+	t, ok := b.targets[annexAnchorName(name)]
+
+	return t, ok
+}
+
+// anchorNames lists the valid names given to \anchor() in items, table cells
+// included, in the order they are rendered.
+func anchorNames(items []Item) []string {
+	names := []string{}
+	for _, it := range items {
+		switch {
+		case it.typ == ItemTableRow:
+			for _, cell := range splitCells(it.val) {
+				if cellItems, err := cellItems(cell); err == nil {
+					names = append(names, anchorNames(cellItems)...)
+				}
+			}
+		case it.typ == ItemCommand && commandName(it) == "anchor":
+			args := parseArgs(strings.SplitN(it.val, "|", 2)[1])
+			if len(args) == 1 && args[0] != "" && anchorName(args[0]) == args[0] {
+				names = append(names, args[0])
+			}
+		}
+	}
+
+	return names
+}
+
+// headingAnchors hands out the anchor of each heading in the order render
+// visits them.
+type headingAnchors struct {
+	anchors []string
+	next    int
+}
+
+func (h *headingAnchors) take() string {
+	if h.next >= len(h.anchors) {
+		return ""
+	}
+	h.next++
+
+	return h.anchors[h.next-1]
+}
+
+// skip passes the anchors of the n headings left out of a listing.
+func (h *headingAnchors) skip(n int) {
+	h.next += n
+}
+
+func (b *Builder) handleBegin(args []string) {
+	if len(args) != 1 || !admonitions[args[0]] {
+		b.errorf("begin: expected one of note, warning, tip or example, got %q", strings.Join(args, ", "))
+		return
+	}
+
+	if open := b.openCommandBlock(); admonitions[open] {
+		b.errorf("begin: %s inside %s", args[0], open)
+		return
+	}
+
+	b.openBlock(args[0], false, fmt.Sprintf("<aside class='%s'>\n", args[0]), "</aside>\n")
+}
+
+var statBlockFields = []string{"name", "hp", "ac", "speed"}
+
+// lazyImage holds the attributes deferring the loading of images when
+// LazyImages is set.
+func (b *Builder) lazyImage() string {
+	if !b.Config.LazyImages {
+		return ""
+	}
+
+	return " loading='lazy' decoding='async'"
+}
+
+// parseImageSize reads an img size argument: w300, h200 or both, as in
+// w300h200.
+func parseImageSize(size string) (width string, height string) {
+	for size != "" {
+		end := strings.IndexAny(size[1:], "wh") + 1
+		if end == 0 {
+			end = len(size)
+		}
+
+		switch size[0] {
+		case 'w':
+			width = size[1:end]
+		case 'h':
+			height = size[1:end]
+		}
+		size = size[end:]
+	}
+
+	return width, height
+}
+
+func (b *Builder) handleStatBlock(args []string) {
+	if len(args) != len(statBlockFields) {
+		b.errorf("statblock: expected %d args (%s), got %d", len(statBlockFields), strings.Join(statBlockFields, ", "), len(args))
+		return
+	}
+	for i, field := range statBlockFields {
+		if args[i] == "" {
+			b.errorf("statblock: missing %s", field)
+			return
+		}
+	}
+
+	labels := b.labels()
+	b.closeParagraph()
+	b.append("<div class='statblock'>\n<div class='statblock-name'>%s</div>\n<dl>\n", escapeText(args[0]))
+	for i, label := range []string{labels.HitPoints, labels.ArmorClass, labels.Speed} {
+		b.append("<dt>%s</dt><dd>%s</dd>\n", escapeText(label), escapeText(args[i+1]))
+	}
+	b.append("</dl>\n</div>\n")
+}
+
+func (b *Builder) handleFigure(args []string) {
+	if len(args) < 2 {
+		b.errorf("figure: expected 2 args (src, caption), got %d", len(args))
+		return
+	}
+	if args[0] == "" {
+		b.errorf("figure: missing src")
+		return
+	}
+
+	b.figureCount++
+	caption := strings.Join(args[1:], ", ")
+	b.closeParagraph()
+	b.append("<figure id='%s'>\n", b.prefixAnchor(fmt.Sprintf("figure-%d", b.figureCount)))
+	b.append("<img src='%s' alt='%s'%s/>\n", escapeAttr(args[0]), escapeAttr(caption), b.lazyImage())
+	b.append("<figcaption>%s %d: %s</figcaption>\n</figure>\n", escapeText(b.labels().Figure), b.figureCount, escapeText(caption))
+}
+
+func (b *Builder) handleSeeAlso(args []string) {
+	if len(args) == 0 {
+		b.errorf("seealso: expected at least one target")
+		return
+	}
+
+	links := []string{}
+	for _, name := range args {
+		t, ok := b.findTarget(name)
+		if !ok {
+			if b.Config.StrictLinks {
+				b.errorf("seealso: unknown target %q", name)
+				return
+			}
+			b.warnf("seealso: unknown target %q", name)
+			continue
+		}
+		links = append(links, fmt.Sprintf("<a href='#%s'>%s</a>", escapeAttr(t.anchor), escapeText(t.title)))
+	}
+
+	if len(links) == 0 {
+		return
+	}
+
+	b.closeParagraph()
+	b.append("<p class='see-also'>%s %s</p>\n", escapeText(b.labels().SeeAlso), strings.Join(links, ", "))
+}
+
+type crumb struct {
+	title  string
+	anchor string
+}
+
+func (b *Builder) buildBreadcrumb(ancestors []crumb, title string) {
+	b.append("<nav class='breadcrumb'>")
+	for _, c := range ancestors {
+		b.append("<a href='#%s'>%s</a> › ", escapeAttr(c.anchor), escapeText(c.title))
+	}
+	b.append("<span>%s</span></nav>\n", escapeText(title))
+}
+
+// breadcrumb emits the trail of the headings above a section, then records
+// the section as the ancestor of the deeper ones.
+func (b *Builder) breadcrumb(level int, title string, anchor string) {
+	if len(b.ancestors) > level-1 {
+		b.ancestors = b.ancestors[:level-1]
+	}
+	if b.Config.Breadcrumbs && len(b.ancestors) > 0 {
+		b.buildBreadcrumb(b.ancestors, title)
+	}
+	b.ancestors = append(b.ancestors, crumb{title: title, anchor: anchor})
+}
+
+func (b HTMLRenderer) Heading(level int, number string, title string) {
+	if b.unclosedBlock(fmt.Sprintf("before %q", title), false) {
+		return
+	}
+	b.closeParagraph()
+	anchor := b.headings.take()
+	tag := b.headingTag(level)
+	switch level {
+	case 1:
+		b.clearFloats()
+		b.newSection = true
+		b.chapterNumber = number
+		b.sectionCount = 0
+		b.append("<%s%s><a id='%s'></a>%s - %s</%s>\n", tag, b.headingClass(), escapeAttr(anchor), number, escapeText(title), tag)
+		b.ancestors = []crumb{{title: title, anchor: anchor}}
+	case 2:
+		b.clearFloats()
+		b.newSection = true
+		b.sectionCount++
+		if number == "" && b.Config.NumberSections && b.chapterNumber != "" {
+			number = fmt.Sprintf("%s.%d", b.chapterNumber, b.sectionCount)
+		}
+		b.breadcrumb(level, title, anchor)
+		if number != "" {
+			b.append("<%s%s><a name='%s'></a>%s - %s</%s>\n", tag, b.headingClass(), escapeAttr(anchor), number, escapeText(title), tag)
+		} else {
+			b.append("<%s%s><a name='%s'></a>%s</%s>\n", tag, b.headingClass(), escapeAttr(anchor), escapeText(title), tag)
+		}
+	default:
+		b.clearFloats()
+		b.newSection = true
+		b.breadcrumb(level, title, anchor)
+		if number != "" {
+			b.append("<%s%s><a name='%s'></a>%s - %s</%s>\n", tag, b.headingClass(), escapeAttr(anchor), number, escapeText(title), tag)
+		} else {
+			b.append("<%s%s><a name='%s'></a>%s</%s>\n", tag, b.headingClass(), escapeAttr(anchor), escapeText(title), tag)
+		}
+	}
+}
+
+func (b HTMLRenderer) AnnexOpen(letter string, title string) {
+	if b.unclosedBlock(fmt.Sprintf("before %q", title), true) {
+		return
+	}
+	b.closeParagraph()
+	b.clearFloats()
+	anchor := b.headings.take()
+	tag := b.headingTag(1)
+	b.chapterNumber = ""
+	b.append("<div class='annex'>\n")
+	b.append("<%s%s><a name='%s'></a>%s %v: %s</%s>\n", tag, b.headingClass(), escapeAttr(anchor), escapeText(b.labels().Annex), letter, escapeText(title), tag)
+	b.newSection = true
+	b.ancestors = []crumb{{title: title, anchor: anchor}}
+}
+
+func (b HTMLRenderer) AnnexClose() {
+	if b.unclosedBlock("at the end of the annex", true) {
+		return
+	}
+	b.closeParagraph()
+	b.clearFloats()
+	b.append("</div>\n")
+}
+
+// tocDepth is how many heading levels the table of contents lists, 0 for
+// none: TOCDepth when set, else 2 with TableOfContents, 3 with TOCSubSections.
+func (b *Builder) tocDepth() int {
+	switch {
+	case b.Config.TOCDepth > 0:
+		return b.Config.TOCDepth
+	case !b.Config.TableOfContents:
+		return 0
+	case b.Config.TOCSubSections:
+		return 3
+	default:
+		return 2
+	}
+}
+
+// skipSections passes the anchors of sections left out of the table of
+// contents.
+func skipSections(sections []Section, anchors *headingAnchors) {
+	for _, section := range sections {
+		anchors.skip(1 + len(section.SubSections))
+	}
+}
+
+func (b *Builder) buildTableOfContentsSubSections(section Section, anchors *headingAnchors) {
+	if b.tocDepth() < 3 || len(section.SubSections) == 0 {
+		anchors.skip(len(section.SubSections))
+		return
+	}
+
+	b.append("<ol>\n")
+	for _, sub := range section.SubSections {
+		b.append("<li><a href='#%s'>%s</a></li>\n", escapeAttr(anchors.take()), escapeText(sub.Title))
+	}
+	b.append("</ol>\n")
+}
+
+func (b *Builder) buildTableOfContents(document Document) {
+	anchors := headingAnchors{anchors: b.headings.anchors}
+
+	tag := b.headingTag(2)
+	b.append("<div id='%s'>\n<%s%s>%s</%s>\n", b.prefixAnchor("summary"), tag, b.headingClass(), escapeText(b.labels().TableOfContents), tag)
+	if b.tocDepth() > 1 {
+		b.append("<ol>\n")
+		for _, section := range document.Sections {
+			b.append("<li><a href='#%s'>%s</a>", escapeAttr(anchors.take()), escapeText(section.Title))
+			b.buildTableOfContentsSubSections(section, &anchors)
+			b.append("</li>\n")
+		}
+		b.append("</ol>\n")
+	} else {
+		skipSections(document.Sections, &anchors)
+	}
+
+	b.append("<ol>\n")
+	for chapterIndex, chapter := range document.Chapters {
+		b.append("<li><strong>%s</strong> - <a href='#%s'>%s</a></li>\n", toRoman(chapterIndex+1), escapeAttr(anchors.take()), escapeText(chapter.Title))
+		if b.tocDepth() < 2 {
+			skipSections(chapter.Sections, &anchors)
+			continue
+		}
+		b.append("<ol class='roman'>\n")
+		for sectionIndex, section := range chapter.Sections {
+			if b.Config.NumberSections {
+				b.append("<li><strong>%s</strong> - <a href='#%s'>%s</a>", chapterSectionNumber(chapterIndex, sectionIndex), escapeAttr(anchors.take()), escapeText(section.Title))
+			} else {
+				b.append("<li><a href='#%s'>%s</a>", escapeAttr(anchors.take()), escapeText(section.Title))
+			}
+			b.buildTableOfContentsSubSections(section, &anchors)
+			b.append("</li>\n")
+		}
+		b.append("</ol>\n")
+	}
+	b.append("</ol>\n")
+
+	if !b.Config.TOCExcludeAnnexes {
+		b.append("<ol>\n")
+		for annexIndex, annex := range document.Annexes {
+			b.append("<li><strong>%s %s</strong>: <a href='#%s'>%s</a></li>\n", escapeText(b.labels().Annex), toAnnex(annexIndex), escapeAttr(anchors.take()), escapeText(annex.Title))
+			if b.tocDepth() < 2 {
+				skipSections(annex.Sections, &anchors)
+			} else if len(annex.Sections) > 0 {
+				b.append("<ol>\n")
+				for sectionIndex, section := range annex.Sections {
+					b.append("<li><strong>%s</strong> - <a href='#%s'>%s</a>", annexSectionNumber(annexIndex, sectionIndex), escapeAttr(anchors.take()), escapeText(section.Title))
+					b.buildTableOfContentsSubSections(section, &anchors)
+					b.append("</li>\n")
+				}
+				b.append("</ol>\n")
+			}
+		}
+		b.append("</ol>\n")
+	}
+
+	b.append("</div>\n")
+}
+
+func (b *Builder) labels() Labels {
+	return b.Config.Labels.withDefaults()
+}
+
+func (b *Builder) hasRoot() bool {
+	return b.Config.Lang != "" || b.Config.Grayscale
+}
+
+func (b *Builder) openRoot() {
+	class := "rulebook"
+	if b.Config.Grayscale {
+		class += " grayscale"
+	}
+
+	if b.Config.Lang != "" {
+		b.append("<div class='%s' lang='%s'>\n", class, escapeAttr(b.Config.Lang))
+	} else {
+		b.append("<div class='%s'>\n", class)
+	}
+}
+
+// openDocument starts a complete HTML page for Standalone builds, titled
+// and signed from the front matter unless Title is set.
+func (b *Builder) openDocument(document Document) {
+	b.append("<!DOCTYPE html>\n")
+	if b.Config.Lang != "" {
+		b.append("<html lang='%s'>\n", escapeAttr(b.Config.Lang))
+	} else {
+		b.append("<html>\n")
+	}
+	b.append("<head>\n<meta charset='utf-8'>\n")
+	title := b.Config.Title
+	if title == "" {
+		title = document.Meta["title"]
+	}
+	if title != "" {
+		b.append("<title>%s</title>\n", escapeText(title))
+	}
+	if b.Config.StylesheetHref != "" {
+		b.append("<link rel='stylesheet' href='%s'>\n", escapeAttr(b.Config.StylesheetHref))
+	}
+	b.append("</head>\n<body>\n")
+
+	byline := []string{}
+	for _, key := range []string{"author", "date"} {
+		if value := document.Meta[key]; value != "" {
+			byline = append(byline, escapeText(value))
+		}
+	}
+	if len(byline) > 0 {
+		b.append("<p class='byline'>%s</p>\n", strings.Join(byline, ", "))
+	}
+}
+
+func (b HTMLRenderer) Begin(document Document) {
+	if b.W != nil {
+		b.out = b.W
+	} else if b.out == nil {
+		b.out = ioutil.Discard
+	}
+	b.err = nil
+	b.paragraphIsOpen = false
+	b.leadIsOpen = false
+	b.floatIsOpen = false
+	b.blocks = nil
+	b.listTags = nil
+	b.ancestors = nil
+	b.chapterNumber = ""
+	b.Warnings = nil
+	b.attributions = nil
+	b.errata = nil
+	b.flowCount = 0
+	b.figureCount = 0
+	b.defTag = ""
+	b.collectTargets(document)
+
+	if b.Config.Standalone {
+		b.openDocument(document)
+	}
+
+	if b.hasRoot() {
+		b.openRoot()
+	}
+
+	if b.tocDepth() > 0 {
+		b.buildTableOfContents(document)
+	}
+}
+
+func (b HTMLRenderer) End() {
+	if b.unclosedBlock("at the end of the document", true) {
+		return
+	}
+	for len(b.blocks) > 0 {
+		b.closeBlock()
+	}
+
+	if b.Config.ErrataIndex && len(b.errata) > 0 {
+		b.closeParagraph()
+		b.clearFloats()
+		b.buildErrataIndex()
+	}
+
+	if len(b.attributions) > 0 {
+		b.closeParagraph()
+		b.clearFloats()
+		b.buildAttributions()
+	}
+
+	if b.hasRoot() {
+		b.closeParagraph()
+		b.append("</div>\n")
+	}
+
+	if b.Config.Standalone {
+		b.closeParagraph()
+		b.append("</body>\n</html>\n")
+	}
+}
+
+func (b *Builder) Build(document Document) (string, error) {
+	var out strings.Builder
+	err := b.BuildTo(document, &out)
+
+	return out.String(), err
+}
+
+// BuildTo streams the HTML to w as it is rendered, so on error w holds the
+// output up to the failing line.
+func (b *Builder) BuildTo(document Document, w io.Writer) error {
+	return b.buildTo(context.Background(), document, w)
+}
+
+func (b *Builder) buildTo(ctx context.Context, document Document, w io.Writer) error {
+	out := bufio.NewWriter(w)
+	b.out = out
+	b.err = nil
+
+	if err := render(ctx, document, HTMLRenderer{Builder: b}); err != nil {
+		out.Flush()
+		b.out = nil
+		return err
+	}
+
+	if err := out.Flush(); err != nil && b.err == nil {
+		b.err = err
 	}
+	b.out = nil
 
-	return b.content.String(), b.err
+	return b.err
 }
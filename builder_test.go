@@ -0,0 +1,1680 @@
+package rulebook
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func build(t *testing.T, input string, config BuilderConfig) string {
+	t.Helper()
+
+	var out strings.Builder
+	if err := Build(strings.NewReader(input), &out, config); err != nil {
+		t.Fatalf("build: %v", err)
+	}
+
+	return out.String()
+}
+
+func buildError(t *testing.T, input string, config BuilderConfig) string {
+	t.Helper()
+
+	var out strings.Builder
+	err := Build(strings.NewReader(input), &out, config)
+	if err == nil {
+		t.Fatalf("build: expected an error, got output %q", out.String())
+	}
+
+	return err.Error()
+}
+
+func lint(t *testing.T, input string, config BuilderConfig) []string {
+	t.Helper()
+
+	warnings, err := Lint(strings.NewReader(input), config)
+	if err != nil {
+		t.Fatalf("lint: %v", err)
+	}
+
+	messages := []string{}
+	for _, w := range warnings {
+		messages = append(messages, w.Message)
+	}
+
+	return messages
+}
+
+func assertContains(t *testing.T, out string, wants ...string) {
+	t.Helper()
+
+	for _, want := range wants {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in output:\n%s", want, out)
+		}
+	}
+}
+
+func assertNotContains(t *testing.T, out string, unwanted ...string) {
+	t.Helper()
+
+	for _, s := range unwanted {
+		if strings.Contains(out, s) {
+			t.Errorf("unexpected %q in output:\n%s", s, out)
+		}
+	}
+}
+
+func TestGMOnlyEditions(t *testing.T) {
+	input := "# Rules\n\nPublic text.\n\n\\gmonly()\n## Secret Plot\n\nThe butler did it.\n\\end()\n\n## Combat\n\nRoll dice.\n"
+
+	gm := build(t, input, BuilderConfig{Edition: "gm", TableOfContents: true})
+	assertContains(t, gm, "Public text.", "<div class='gm-only'>", "Secret Plot", "The butler did it.", "Roll dice.")
+
+	player := build(t, input, BuilderConfig{TableOfContents: true})
+	assertContains(t, player, "Public text.", "Roll dice.")
+	assertNotContains(t, player, "gm-only", "Secret Plot", "secret-plot", "butler")
+}
+
+func TestGMOnlyNested(t *testing.T) {
+	input := "# Rules\n\n\\gmonly()\n\\readaloud()\nHidden.\n\\end()\nStill hidden.\n\\end()\nShown.\n"
+
+	player := build(t, input, BuilderConfig{})
+	assertContains(t, player, "Shown.")
+	assertNotContains(t, player, "Hidden.", "Still hidden.")
+}
+
+func TestGMOnlyAcrossList(t *testing.T) {
+	input := "# Rules\n\n\\gmonly()\nsecret\n- a \\end()\n- b\n"
+
+	for _, edition := range []string{"", "gm"} {
+		err := buildError(t, input, BuilderConfig{Edition: edition})
+		assertContains(t, err, "line 5", "gmonly")
+	}
+}
+
+func TestGMOnlyInsideListItem(t *testing.T) {
+	input := "# Rules\n\n- a \\gmonly()secret\\end() b\n- c\n"
+
+	player := build(t, input, BuilderConfig{})
+	assertContains(t, player, "a ", " b", "c")
+	assertNotContains(t, player, "secret")
+}
+
+func TestTokenSheet(t *testing.T) {
+	input := "# Tokens\n\n\\tokens(2)\n\\token(Orc, Dead orc)\n\\token(Elf, Dead elf)\n\\end()\n"
+
+	out := build(t, input, BuilderConfig{})
+	assertContains(t, out,
+		"<div class='token-sheet' style='--columns: 2'>\n",
+		"<div class='tokens-front'>\n<div class='token'>Orc</div>\n<div class='token'>Elf</div>\n</div>\n",
+		// backs are mirrored so they line up with their fronts when printed duplex
+		"<div class='tokens-back'>\n<div class='token'>Dead elf</div>\n<div class='token'>Dead orc</div>\n</div>\n",
+	)
+}
+
+func TestTokenSheetPadsLastRow(t *testing.T) {
+	out := build(t, "# Tokens\n\n\\tokens(3)\n\\token(A, a)\n\\end()\n", BuilderConfig{})
+	assertContains(t, out, "<div class='tokens-back'>\n<div class='token empty'></div>\n<div class='token empty'></div>\n<div class='token'>a</div>\n</div>\n")
+}
+
+func TestTokenSheetColumns(t *testing.T) {
+	for _, columns := range []string{"0", "x", "13", "3000000"} {
+		err := buildError(t, "# Tokens\n\n\\tokens("+columns+")\n\\token(A, a)\n\\end()\n", BuilderConfig{})
+		assertContains(t, err, "line 3", "tokens:")
+	}
+}
+
+func TestFAQ(t *testing.T) {
+	input := "# Rules\n\n\\faq()\n\\q(Can I run?)\n\\a()\nYes, **twice**.\n\\q(Can I fly?)\n\\a()\nNo.\n\\end()\n"
+
+	out := build(t, input, BuilderConfig{})
+	assertContains(t, out,
+		"<div class='faq'>\n<details>\n<summary>Can I run?</summary>\n<div class='answer'>\n",
+		"<strong>twice</strong>",
+		"</div>\n</details>\n<details>\n<summary>Can I fly?</summary>\n<div class='answer'>\n",
+		"</div>\n</details>\n</div>\n",
+	)
+	if n := strings.Count(out, "<details>"); n != 2 {
+		t.Errorf("expected 2 details, got %d", n)
+	}
+}
+
+func TestBlockOpenAcrossHeading(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{name: "rtable", input: "\\rtable(d6)\n\\roll(1-3, A)\n## Next\n\ntext\n"},
+		{name: "faq", input: "\\faq()\n\\q(Q)\n\\a()\nA\n## Next\n\ntext\n"},
+		{name: "shortcuts", input: "\\shortcuts()\n\\shortcut(Ctrl+S, Save)\n## Next\n\ntext\n"},
+		{name: "tokens", input: "\\tokens()\n\\token(A, a)\n## Next\n\ntext\n"},
+		{name: "flow", input: "\\flow()\n\\node(start, Start)\n## Next\n\ntext\n"},
+		{name: "gmonly", input: "\\gmonly()\nsecret\nANNEX Next\n\ntext\n"},
+	}
+
+	for _, test := range tests {
+		err := buildError(t, "# Rules\n\n"+test.input, BuilderConfig{Edition: "gm"})
+		assertContains(t, err, test.name+": block opened on line 3 is not closed before \"Next\"")
+	}
+}
+
+func TestGMOnlyAcrossHeading(t *testing.T) {
+	out := build(t, "# Rules\n\n\\gmonly()\nsecret\n## Next\n\nmore\n\\end()\n", BuilderConfig{Edition: "gm"})
+	assertContains(t, out, "<div class='gm-only'>", "Next</h3>", "more\n</p>\n</div>\n")
+}
+
+func TestGMOnlyOpenAtAnnexEnd(t *testing.T) {
+	err := buildError(t, "ANNEX Extra\n\n\\gmonly()\nsecret\n", BuilderConfig{Edition: "gm"})
+	assertContains(t, err, "gmonly: block opened on line 3 is not closed at the end of the annex")
+}
+
+func TestRawHTML(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: `\html(<a href="https://x.com" class="btn">Go</a>)`, want: `<a href="https://x.com" class="btn">Go</a>`},
+		{input: `\html(<p>a, b</p>)`, want: `<p>a, b</p>`},
+		{input: `\html(<span title='x\y'>(1)</span>)`, want: `<span title='x\y'>(1)</span>`},
+	}
+
+	for _, test := range tests {
+		out := build(t, "# Rules\n\n"+test.input+"\n", BuilderConfig{AllowRawHTML: true})
+		assertContains(t, out, test.want)
+	}
+}
+
+func TestRawHTMLDisabled(t *testing.T) {
+	err := buildError(t, "# Rules\n\n\\html(<script>alert(1)</script>)\n", BuilderConfig{})
+	assertContains(t, err, "line 3: html: raw HTML requires AllowRawHTML")
+}
+
+func TestAnchor(t *testing.T) {
+	input := "# Rules\n\nSee [here](rule-x) now.\n\nSome text \\anchor(rule-x) more.\n"
+
+	out := build(t, input, BuilderConfig{})
+	assertContains(t, out, "<a href='#rule-x'>here</a>", "Some text <a id='rule-x'></a> more.")
+
+	if warnings := lint(t, input, BuilderConfig{}); len(warnings) > 0 {
+		t.Errorf("unexpected warnings: %v", warnings)
+	}
+}
+
+func TestAnchorInTableCell(t *testing.T) {
+	input := "# Rules\n\n[Orcs](orc-row)\n\n-table- Foes\nName|HP\nOrc \\anchor(orc-row)|7\n-table-\n"
+
+	out := build(t, input, BuilderConfig{})
+	assertContains(t, out, "<a href='#orc-row'>Orcs</a>", "<td class='head'>Orc <a id='orc-row'></a></td>\n<td class='lead'>7</td>")
+
+	if warnings := lint(t, input, BuilderConfig{}); len(warnings) > 0 {
+		t.Errorf("unexpected warnings: %v", warnings)
+	}
+}
+
+func TestAnchorErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{input: "\\anchor(spot) \\anchor(spot)", err: `anchor: "spot" is already defined`},
+		{input: "\\anchor(rules)", err: `anchor: "rules" is already used by another target`},
+		{input: "\\anchor(Not Valid)", err: `anchor: invalid name "Not Valid"`},
+		{input: "\\anchor()", err: "anchor: expected 1 arg (name), got 0"},
+	}
+
+	for _, test := range tests {
+		err := buildError(t, "# Rules\n\n"+test.input+"\n", BuilderConfig{})
+		assertContains(t, err, test.err)
+	}
+}
+
+func TestFloatClearedBeforeHeadings(t *testing.T) {
+	for _, heading := range []string{"# Next", "## Next", "### Next", "ANNEX Next"} {
+		out := build(t, "# Rules\n\n## Combat\n\n\\img(orc.png, Orc, right)\n\n"+heading+"\n\ntext\n", BuilderConfig{})
+		assertContains(t, out, "float-right")
+		if !strings.Contains(out, "<div class='clear'></div>\n") || strings.Index(out, "<div class='clear'></div>") > strings.Index(out, "Next") {
+			t.Errorf("%s: expected the float cleared before the heading:\n%s", heading, out)
+		}
+	}
+}
+
+func TestSubSectionHeadings(t *testing.T) {
+	out := build(t, "# Rules\n\n## Combat\n\n### Critical Hits\n\nDouble damage.\n", BuilderConfig{TableOfContents: true, TOCDepth: 3})
+	assertContains(t, out,
+		"<h3><a name='combat'></a>Combat</h3>",
+		"<h4><a name='critical-hits'></a>Critical Hits</h4>",
+		"<a href='#critical-hits'>Critical Hits</a>",
+	)
+	assertNotContains(t, out, "# Critical", ">Critical Hits</h3>")
+
+	document, err := Parse(strings.NewReader("# Rules\n\n## Combat\n\n### Critical Hits\n\n### Fumbles\n"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	subs := document.Chapters[0].Sections[0].SubSections
+	if len(subs) != 2 || subs[0].Title != "Critical Hits" || subs[1].Title != "Fumbles" {
+		t.Errorf("unexpected sub-sections %+v", subs)
+	}
+}
+
+func TestSubSectionsLeftOutOfShallowTOC(t *testing.T) {
+	out := build(t, "# Rules\n\n## Combat\n\n### Critical Hits\n", BuilderConfig{TableOfContents: true})
+	assertNotContains(t, out, "href='#critical-hits'")
+}
+
+func TestSpan(t *testing.T) {
+	out := build(t, "# Rules\n\nSome \\span(x < y, note-box_2) more text.\n", BuilderConfig{})
+	assertContains(t, out, "<p class='indent'>\nSome <span class='note-box_2'>x &lt; y</span> more text.\n</p>")
+}
+
+func TestSpanOpensParagraph(t *testing.T) {
+	out := build(t, "# Rules\n\n\\span(x, note) more text\n", BuilderConfig{})
+	assertContains(t, out, "<p class='indent'>\n<span class='note'>x</span> more text")
+}
+
+func TestSpanRejectsInvalidClass(t *testing.T) {
+	for _, class := range []string{`foo' onclick='x`, "a b", "x;y", `"a&quot;"`, ""} {
+		err := buildError(t, "# Rules\n\n\\span(text, "+class+")\n", BuilderConfig{})
+		assertContains(t, err, "line 3: span: invalid class name")
+	}
+}
+
+func TestColor(t *testing.T) {
+	tests := []struct {
+		color string
+		style string
+	}{
+		{color: "FF0000", style: "color: #ff0000"},
+		{color: "#abc", style: "color: #abc"},
+		{color: "11223344", style: "color: #11223344"},
+		{color: "Red", style: "color: red"},
+	}
+
+	for _, test := range tests {
+		out := build(t, "# Rules\n\nSome \\color(hot, "+test.color+") text\n", BuilderConfig{})
+		assertContains(t, out, "<p class='indent'>\nSome <span style='"+test.style+"'>hot</span> text")
+	}
+}
+
+func TestColorOpensParagraph(t *testing.T) {
+	out := build(t, "# Rules\n\n\\color(x, red) more text\n", BuilderConfig{})
+	assertContains(t, out, "<p class='indent'>\n<span style='color: red'>x</span> more text")
+
+	gray := build(t, "# Rules\n\n\\color(x, red) more text\n", BuilderConfig{Grayscale: true})
+	assertContains(t, gray, "<p class='indent'>\n<strong class='color'>x</strong> more text")
+}
+
+func TestColorRejectsInvalidValues(t *testing.T) {
+	for _, color := range []string{"red; } body{", "12345", "ggg", "#", "transparent' onmouseover='x", ""} {
+		for _, grayscale := range []bool{false, true} {
+			err := buildError(t, "# Rules\n\n\\color(x, "+color+")\n", BuilderConfig{Grayscale: grayscale})
+			assertContains(t, err, "line 3: color: invalid color")
+		}
+	}
+}
+
+func TestColorBackground(t *testing.T) {
+	out := build(t, "# Rules\n\n\\color(fg, ff0000) and \\color(both, ff0000, 000000)\n", BuilderConfig{})
+	assertContains(t, out,
+		"<span style='color: #ff0000'>fg</span>",
+		"<span style='color: #ff0000; background-color: #000000'>both</span>",
+	)
+
+	err := buildError(t, "# Rules\n\n\\color(x, red, bad;)\n", BuilderConfig{})
+	assertContains(t, err, `line 3: color: invalid background-color "bad;"`)
+
+	err = buildError(t, "# Rules\n\n\\color(x, red, blue, green)\n", BuilderConfig{})
+	assertContains(t, err, "color: expected 2 or 3 args (text, color, background), got 4")
+}
+
+func TestTOCExcludeAnnexes(t *testing.T) {
+	input := "# Combat\n\n## Attack\n\nANNEX Bestiary\n\ntext\n"
+
+	out := build(t, input, BuilderConfig{TableOfContents: true})
+	assertContains(t, out, "<a href='#combat'>Combat</a>", "<a href='#attack'>Attack</a>", "<a href='#annex-bestiary'>Bestiary</a>")
+
+	out = build(t, input, BuilderConfig{TableOfContents: true, TOCExcludeAnnexes: true})
+	assertContains(t, out, "<a href='#combat'>Combat</a>", "<a href='#attack'>Attack</a>", "<a name='annex-bestiary'></a>")
+	assertNotContains(t, out, "href='#annex-bestiary'")
+}
+
+func TestCoalesceText(t *testing.T) {
+	tests := []struct {
+		items []Item
+		want  []Item
+	}{
+		{items: []Item{}, want: []Item{}},
+		{
+			items: []Item{{typ: ItemText, val: "a"}, {typ: ItemText, val: "b"}, {typ: ItemText, val: "c"}},
+			want:  []Item{{typ: ItemText, val: "abc"}},
+		},
+		{
+			items: []Item{{typ: ItemText, val: "a"}, {typ: ItemBold, val: "b"}, {typ: ItemText, val: "c"}, {typ: ItemText, val: "d"}},
+			want:  []Item{{typ: ItemText, val: "a"}, {typ: ItemBold, val: "b"}, {typ: ItemText, val: "cd"}},
+		},
+		{
+			items: []Item{{typ: ItemBold, val: "a"}, {typ: ItemBold, val: "b"}},
+			want:  []Item{{typ: ItemBold, val: "a"}, {typ: ItemBold, val: "b"}},
+		},
+	}
+
+	for _, test := range tests {
+		if got := coalesceText(test.items); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("coalesceText = %v, want %v", got, test.want)
+		}
+	}
+}
+
+// syntheticRulebook writes a rulebook of the given number of chapters, each
+// with sections mixing paragraphs, markup, lists and tables.
+func syntheticRulebook(chapters int) string {
+	var s strings.Builder
+	for c := 0; c < chapters; c++ {
+		fmt.Fprintf(&s, "# Chapter %d\n\n", c)
+		for section := 0; section < 5; section++ {
+			fmt.Fprintf(&s, "## Section %d.%d\n\n", c, section)
+			s.WriteString("The party rolls **initiative**, then acts in order \\* with *care* and `1d20` \\dice(1d20+2).\n")
+			s.WriteString("See [Combat](chapter-0) for the ~~old~~ rules, ==new== as of 2^nd^ edition.\n\n")
+			s.WriteString("- attack\n- defend\n  - parry\n- flee\n\n")
+			s.WriteString("-table- Weapons\nName|Damage\nSword|1d8\nAxe|1d10\n-table-\n\n")
+		}
+	}
+
+	return s.String()
+}
+
+// splitText undoes coalesceText, cutting text items after each space as the
+// lexer would around markup.
+func splitText(items []Item) []Item {
+	split := []Item{}
+	for _, it := range items {
+		if it.typ != ItemText {
+			split = append(split, it)
+			continue
+		}
+		for _, word := range strings.SplitAfter(it.val, " ") {
+			split = append(split, Item{typ: ItemText, val: word, line: it.line})
+		}
+	}
+
+	return split
+}
+
+func splitDocument(document Document) Document {
+	split := document
+	split.Chapters = nil
+	for _, chapter := range document.Chapters {
+		chapter.Items = splitText(chapter.Items)
+		sections := []Section{}
+		for _, section := range chapter.Sections {
+			section.Items = splitText(section.Items)
+			sections = append(sections, section)
+		}
+		chapter.Sections = sections
+		split.Chapters = append(split.Chapters, chapter)
+	}
+
+	return split
+}
+
+func TestCoalescedOutputIdentical(t *testing.T) {
+	document, err := Parse(strings.NewReader(syntheticRulebook(2)))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	coalesced, err := (&Builder{}).Build(document)
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	split, err := (&Builder{}).Build(splitDocument(document))
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+
+	if coalesced != split {
+		t.Errorf("coalescing changed the output")
+	}
+}
+
+// countingWriter counts the writes the renderer makes.
+type countingWriter struct {
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return len(p), nil
+}
+
+func BenchmarkCoalesceText(b *testing.B) {
+	document, err := Parse(strings.NewReader(syntheticRulebook(20)))
+	if err != nil {
+		b.Fatalf("parse: %v", err)
+	}
+
+	for name, document := range map[string]Document{"split": splitDocument(document), "coalesced": document} {
+		b.Run(name, func(b *testing.B) {
+			var w countingWriter
+			for i := 0; i < b.N; i++ {
+				Render(document, HTMLRenderer{Builder: &Builder{}, W: &w})
+			}
+			b.ReportMetric(float64(w.writes)/float64(b.N), "writes/op")
+		})
+	}
+}
+
+func TestBuildToStreamsSameOutput(t *testing.T) {
+	document, err := Parse(strings.NewReader(syntheticRulebook(3)))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	built, err := (&Builder{}).Build(document)
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+
+	var streamed strings.Builder
+	if err := (&Builder{}).BuildTo(document, &streamed); err != nil {
+		t.Fatalf("build to: %v", err)
+	}
+
+	if streamed.String() != built {
+		t.Errorf("streamed output differs from Build")
+	}
+}
+
+func TestBuildToKeepsOutputBeforeError(t *testing.T) {
+	var out strings.Builder
+	err := Build(strings.NewReader("# Rules\n\nBefore the error.\n\n\\color(x)\n"), &out, BuilderConfig{})
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	assertContains(t, out.String(), "Before the error.")
+}
+
+func BenchmarkBuild(b *testing.B) {
+	document, err := Parse(strings.NewReader(syntheticRulebook(50)))
+	if err != nil {
+		b.Fatalf("parse: %v", err)
+	}
+
+	b.Run("string", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := (&Builder{}).Build(document); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("stream", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := (&Builder{}).BuildTo(document, ioutil.Discard); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestFloatStaysInItsSection(t *testing.T) {
+	out := build(t, "# Rules\n\n\\img(orc.png, Orc, left)\nThe orc.\n\n## Combat\n\nRoll dice.\n\n## Magic\n\nCast spells.\n", BuilderConfig{})
+	assertContains(t, out, "<img class='illustration float-left' src='orc.png' alt='Orc' />",
+		"</p>\n<div class='clear'></div>\n<h3><a name='combat'></a>Combat</h3>")
+	if n := strings.Count(out, "<div class='clear'></div>"); n != 1 {
+		t.Errorf("expected the float cleared once, got %d:\n%s", n, out)
+	}
+
+	out = build(t, "# Rules\n\n\\img(orc.png, Orc, center)\n\n## Combat\n", BuilderConfig{})
+	assertNotContains(t, out, "float-", "class='clear'")
+}
+
+func TestAnchorPrefix(t *testing.T) {
+	input := "# Rules\n\nSee [the combat rules](Combat).\n\n## Combat\n\n\\seealso(Rules)\n\nANNEX Extra\n"
+
+	out := build(t, input, BuilderConfig{AnchorPrefix: "book1", TableOfContents: true})
+	assertContains(t, out,
+		"<div id='book1-summary'>",
+		"<a href='#book1-rules'>Rules</a>",
+		"<a href='#book1-annex-extra'>Extra</a>",
+		"<h2><a id='book1-rules'></a>I - Rules</h2>",
+		"See <a href='#book1-combat'>the combat rules</a>.",
+		"<h3><a name='book1-combat'></a>Combat</h3>",
+		"<h2><a name='book1-annex-extra'></a>",
+	)
+
+	anchors := regexp.MustCompile(`(?:href='#|id='|name=')([^']*)'`).FindAllStringSubmatch(out, -1)
+	if len(anchors) == 0 {
+		t.Fatalf("no anchors in output:\n%s", out)
+	}
+	for _, anchor := range anchors {
+		if !strings.HasPrefix(anchor[1], "book1-") {
+			t.Errorf("anchor %q is not prefixed", anchor[1])
+		}
+	}
+
+	out = build(t, input, BuilderConfig{TableOfContents: true})
+	assertNotContains(t, out, "book1")
+	assertContains(t, out, "<a href='#combat'>the combat rules</a>")
+}
+
+func TestBreadcrumbs(t *testing.T) {
+	input := "# Rules\n\n## Combat\n\nText.\n\n### Critical Hits\n\n# Magic\n\n## Spells\n\nANNEX Extra\n\n## Tables\n"
+
+	out := build(t, input, BuilderConfig{Breadcrumbs: true})
+	assertContains(t, out,
+		"<nav class='breadcrumb'><a href='#rules'>Rules</a> › <span>Combat</span></nav>\n<h3><a name='combat'></a>Combat</h3>",
+		"<nav class='breadcrumb'><a href='#rules'>Rules</a> › <a href='#combat'>Combat</a> › <span>Critical Hits</span></nav>\n<h4><a name='critical-hits'></a>Critical Hits</h4>",
+		"<nav class='breadcrumb'><a href='#magic'>Magic</a> › <span>Spells</span></nav>\n<h3><a name='spells'></a>Spells</h3>",
+		"<nav class='breadcrumb'><a href='#annex-extra'>Extra</a> › <span>Tables</span></nav>",
+	)
+	assertNotContains(t, out, "<a href='#rules'>Rules</a> › <span>Spells</span>")
+	if n := strings.Count(out, "<nav class='breadcrumb'>"); n != 4 {
+		t.Errorf("expected 4 breadcrumbs, got %d", n)
+	}
+
+	out = build(t, input, BuilderConfig{})
+	assertNotContains(t, out, "breadcrumb")
+}
+
+func TestTableDataLabels(t *testing.T) {
+	input := "# Rules\n\n-table- Weapons\nName|**Damage**\nSword|d8\nAxe|d10\n-table-\n"
+
+	out := build(t, input, BuilderConfig{TableDataLabels: true})
+	assertContains(t, out,
+		"<td class='head'>Name</td>\n<td class='head'><strong>Damage</strong></td>\n",
+		"<td class='head' data-label='Name'>Sword</td>\n<td class='lead' data-label='Damage'>d8</td>\n",
+		"<td class='head' data-label='Name'>Axe</td>\n<td class='lead' data-label='Damage'>d10</td>\n",
+	)
+	if n := strings.Count(out, "data-label="); n != 4 {
+		t.Errorf("expected 4 data labels, got %d", n)
+	}
+
+	out = build(t, input, BuilderConfig{})
+	assertNotContains(t, out, "data-label")
+}
+
+func TestDefaultListType(t *testing.T) {
+	input := "# Rules\n\n- one\n- two\n\n1. first\n2. second\n"
+
+	tests := []struct {
+		listType string
+		open     string
+		close    string
+	}{
+		{listType: "", open: "<ol class='roman'>", close: "</ol>"},
+		{listType: "ol", open: "<ol class='roman'>", close: "</ol>"},
+		{listType: "ul", open: "<ul>", close: "</ul>"},
+	}
+
+	for _, test := range tests {
+		out := build(t, input, BuilderConfig{DefaultListType: test.listType})
+		assertContains(t, out, test.open+"\n\n<li>\n<p>\none", "two\n</p>\n\n</li>\n"+test.close, "<ol class='decimal'>")
+	}
+}
+
+func TestBar(t *testing.T) {
+	out := build(t, "# Rules\n\nSanity \\bar(Sanity, 3, 10) left.\n", BuilderConfig{})
+	assertContains(t, out, "Sanity <span class='tracker'>Sanity <progress value='3' max='10' aria-label='Sanity'>3/10</progress></span> left.")
+
+	tests := []struct {
+		args string
+		err  string
+	}{
+		{args: "Sanity, 3", err: "bar: expected 3 args (label, value, max), got 2"},
+		{args: "Sanity, three, 10", err: "bar: value \"three\" is not a number"},
+		{args: "Sanity, 3, ten", err: "bar: max \"ten\" is not a number"},
+		{args: "Sanity, 11, 10", err: "bar: value 11 must be between 0 and max 10"},
+		{args: "Sanity, -1, 10", err: "bar: value -1 must be between 0 and max 10"},
+		{args: "Sanity, 0, 0", err: "bar: value 0 must be between 0 and max 0"},
+	}
+
+	for _, test := range tests {
+		err := buildError(t, "# Rules\n\n\\bar("+test.args+")\n", BuilderConfig{})
+		assertContains(t, err, "line 3: "+test.err)
+	}
+}
+
+func TestIllustrationClass(t *testing.T) {
+	input := "# Rules\n\n\\img(orc.png, Orc, left)\n\n\\img(elf.png, Elf, right)\n\n\\img(map.png, Map)\n"
+
+	out := build(t, input, BuilderConfig{IllustrationClass: "art framed"})
+	assertContains(t, out,
+		"<img class='art framed float-left' src='orc.png' alt='Orc' />",
+		"<img class='art framed float-right' src='elf.png' alt='Elf' />",
+		"<img class='art framed' src='map.png' alt='Map' />",
+	)
+	assertNotContains(t, out, "illustration")
+
+	out = build(t, input, BuilderConfig{})
+	assertContains(t, out, "<img class='illustration float-left'", "<img class='illustration' src='map.png'")
+}
+
+func TestAttributions(t *testing.T) {
+	out := build(t, "# Rules\n\n\\attribution(OGL 1.0a, Wizards)\n\n## Elves\n\n\\attribution(OGL 1.0a, Wizards)\n\\attribution(CC-BY Ana)\n", BuilderConfig{})
+	assertContains(t, out, "<div class='license'>\n<h2>Licences</h2>\n<ul>\n<li>OGL 1.0a, Wizards</li>\n<li>CC-BY Ana</li>\n</ul>\n</div>\n")
+	if n := strings.Count(out, "OGL 1.0a"); n != 1 {
+		t.Errorf("expected the attribution once, got %d:\n%s", n, out)
+	}
+	if strings.Index(out, "class='license'") < strings.Index(out, "Elves") {
+		t.Errorf("expected the license section at the end:\n%s", out)
+	}
+
+	out = build(t, "# Rules\n\nText.\n", BuilderConfig{})
+	assertNotContains(t, out, "license")
+}
+
+func TestShortcuts(t *testing.T) {
+	out := build(t, "# Rules\n\n\\shortcuts()\n\\shortcut(Ctrl+Shift+S, Save the sheet)\n\\shortcut(?, Help)\n\\end()\n", BuilderConfig{})
+	assertContains(t, out,
+		"<table class='shortcuts'>\n<tbody>\n",
+		"<tr>\n<td class='head'><kbd>Ctrl</kbd>+<kbd>Shift</kbd>+<kbd>S</kbd></td>\n<td class='lead'>Save the sheet</td>\n</tr>\n",
+		"<tr>\n<td class='head'><kbd>?</kbd></td>\n<td class='lead'>Help</td>\n</tr>\n",
+		"</tbody>\n</table>\n",
+	)
+	if n := strings.Count(out, "<kbd>"); n != 4 {
+		t.Errorf("expected 4 kbd elements, got %d", n)
+	}
+}
+
+func TestListAfterHeadingNotIndented(t *testing.T) {
+	input := "# Rules\n\n- one\n- two\n\nText.\n\n## Next\n\nPara.\n"
+
+	out := build(t, input, BuilderConfig{})
+	assertContains(t, out, "<li>\n<p>\none\n</p>", "<p>\nText.\n</p>", "<p class='indent'>\nPara.\n</p>")
+	if n := strings.Count(out, "class='indent'"); n != 1 {
+		t.Errorf("expected only the paragraph after the section heading indented, got %d:\n%s", n, out)
+	}
+
+	out = build(t, input, BuilderConfig{IndentListItems: true})
+	assertContains(t, out, "<li>\n<p class='indent'>\none\n</p>", "<li>\n<p>\ntwo\n</p>")
+}
+
+func TestCompactPairTables(t *testing.T) {
+	input := "# Rules\n\n-table- Mods\nSTR|+1\nDEX|+2\n-table-\n\n-table- Three\na|b|c\n-table-\n"
+
+	out := build(t, input, BuilderConfig{CompactPairTables: true})
+	assertContains(t, out,
+		"<table class='compact' aria-label='Mods'>\n<tbody>\n<tr>\n<td class='head'>STR</td>",
+		"<table>\n<thead>\n<tr>\n<th colspan='3'>Three</th>",
+	)
+	assertNotContains(t, out, "<th colspan='2'>Mods</th>")
+
+	out = build(t, input, BuilderConfig{})
+	assertContains(t, out, "<th colspan='2'>Mods</th>")
+	assertNotContains(t, out, "compact")
+}
+
+func TestChallengeRating(t *testing.T) {
+	input := "# Rules\n\nOrc \\cr(1/2), dragon \\cr(30), rat \\cr(0).\n"
+	out := build(t, input, BuilderConfig{})
+	assertContains(t, out,
+		"Orc <span class='cr' data-cr='1/2'>1/2</span>",
+		"dragon <span class='cr' data-cr='30'>30</span>",
+		"rat <span class='cr' data-cr='0'>0</span>.",
+	)
+	if warnings := lint(t, input, BuilderConfig{}); len(warnings) > 0 {
+		t.Errorf("unexpected warnings %v", warnings)
+	}
+
+	for _, rating := range []string{"1/3", "31", "-1", "high"} {
+		input := "# Rules\n\nBeast \\cr(" + rating + ").\n"
+		out := build(t, input, BuilderConfig{})
+		assertContains(t, out, "<span class='cr' data-cr='"+rating+"'>"+rating+"</span>")
+
+		warnings := lint(t, input, BuilderConfig{})
+		if len(warnings) != 1 || warnings[0] != fmt.Sprintf("cr: invalid challenge rating %q", rating) {
+			t.Errorf("%s: unexpected warnings %v", rating, warnings)
+		}
+	}
+}
+
+func TestMedia(t *testing.T) {
+	out := build(t, "# Rules\n\n\\media(https://maps.example.com/?a=1&b=2, 4:3)\n", BuilderConfig{AllowRawHTML: true})
+	assertContains(t, out, "<div class='media-embed' style='aspect-ratio:4/3'>\n<iframe src='https://maps.example.com/?a=1&amp;b=2' allowfullscreen></iframe>\n</div>\n")
+
+	tests := []struct {
+		args   string
+		config BuilderConfig
+		err    string
+	}{
+		{args: "https://example.com, 16:9", err: "media: embeds require AllowRawHTML"},
+		{args: "https://example.com", config: BuilderConfig{AllowRawHTML: true}, err: "media: expected 2 args (url, ratio), got 1"},
+		{args: "https://example.com, 16/9", config: BuilderConfig{AllowRawHTML: true}, err: "media: invalid ratio \"16/9\", expected width:height"},
+		{args: "https://example.com, 16:0", config: BuilderConfig{AllowRawHTML: true}, err: "media: invalid ratio \"16:0\", expected width:height"},
+		{args: "https://example.com, 16:9'x", config: BuilderConfig{AllowRawHTML: true}, err: "media: invalid ratio \"16:9'x\", expected width:height"},
+	}
+
+	for _, test := range tests {
+		err := buildError(t, "# Rules\n\n\\media("+test.args+")\n", test.config)
+		assertContains(t, err, test.err)
+	}
+}
+
+func TestLeadSentence(t *testing.T) {
+	input := "# Rules\n\nThe orc attacks. It hits hard.\n\nSecond paragraph. Here.\n\n## Next\n\nSee p. 12 for **details**! Then more.\n"
+
+	out := build(t, input, BuilderConfig{LeadSentence: true})
+	assertContains(t, out,
+		"<span class='lead'>The orc attacks.</span> It hits hard.",
+		"<p>\nSecond paragraph. Here.\n</p>",
+		"<span class='lead'>See p. 12 for <strong>details</strong>!</span> Then more.",
+	)
+	if n := strings.Count(out, "<span class='lead'>"); n != 2 {
+		t.Errorf("expected 2 lead sentences, got %d", n)
+	}
+
+	out = build(t, input, BuilderConfig{})
+	assertNotContains(t, out, "class='lead'")
+}
+
+func TestSentenceEnd(t *testing.T) {
+	tests := []struct {
+		s   string
+		end int
+	}{
+		{s: "One. Two.", end: 4},
+		{s: "Really? Yes.", end: 7},
+		{s: "e.g. this one. Next", end: 14},
+		{s: "No end", end: -1},
+		{s: "Ends here.", end: -1},
+		{s: "3.5 damage. Next", end: 11},
+	}
+
+	for _, test := range tests {
+		if end := sentenceEnd(test.s); end != test.end {
+			t.Errorf("sentenceEnd(%q) = %d, want %d", test.s, end, test.end)
+		}
+	}
+}
+
+func TestErrataNotes(t *testing.T) {
+	input := "# Rules\n\nDamage is d8 \\erratanote(was d6 before 2024).\n\n## Next\n\nX \\erratanote(typo <fixed>)\n"
+
+	out := build(t, input, BuilderConfig{ErrataIndex: true})
+	assertContains(t, out,
+		"Damage is d8 <span class='errata' id='errata-1' tabindex='0' title='was d6 before 2024'>†<span class='errata-text'>was d6 before 2024</span></span>.",
+		"<span class='errata' id='errata-2' tabindex='0' title='typo &lt;fixed&gt;'>†<span class='errata-text'>typo &lt;fixed&gt;</span></span>",
+		"<div class='errata-index'>\n<h2>Errata</h2>\n<ol>\n<li><a href='#errata-1'>was d6 before 2024</a></li>\n<li><a href='#errata-2'>typo &lt;fixed&gt;</a></li>\n</ol>\n</div>\n",
+	)
+
+	out = build(t, input, BuilderConfig{})
+	assertContains(t, out, "<span class='errata-text'>was d6 before 2024</span>")
+	assertNotContains(t, out, "errata-index")
+}
+
+func TestLangAndHeadingHyphens(t *testing.T) {
+	input := "# Rules\n\n## Next\n\n### Deep\n\nANNEX Extra\n"
+
+	out := build(t, input, BuilderConfig{Lang: "fr-CA", NoHeadingHyphens: true})
+	if !strings.HasPrefix(out, "<div class='rulebook' lang='fr-CA'>\n") || !strings.HasSuffix(out, "</div>\n</div>\n") {
+		t.Errorf("expected the output wrapped in a lang root:\n%s", out)
+	}
+	assertContains(t, out,
+		"<h2 class='no-hyphens'><a id='rules'></a>I - Rules</h2>",
+		"<h3 class='no-hyphens'><a name='next'></a>Next</h3>",
+		"<h4 class='no-hyphens'><a name='deep'></a>Deep</h4>",
+		"<h2 class='no-hyphens'><a name='annex-extra'></a>",
+	)
+
+	out = build(t, input, BuilderConfig{Lang: "fr", Standalone: true})
+	assertContains(t, out, "<html lang='fr'>", "<div class='rulebook' lang='fr'>")
+	assertNotContains(t, out, "no-hyphens")
+
+	out = build(t, input, BuilderConfig{})
+	assertNotContains(t, out, "lang=", "no-hyphens", "class='rulebook'")
+}
+
+func TestReadAloud(t *testing.T) {
+	out := build(t, "# Rules\n\n\\readaloud()\nThe door *creaks* open.\nA **cold** wind blows.\n\nYou hear steps.\n\\end()\n\nAfter.\nThe end.\n", BuilderConfig{})
+	assertContains(t, out,
+		"<div class='read-aloud'>\n<p class='indent'>\nThe door <i>creaks</i> open.<br/>\nA <strong>cold</strong> wind blows.\n</p>\n<p>\nYou hear steps.\n</p>\n</div>\n",
+		"<p>\nAfter.\n</p>\n<p>\nThe end.\n</p>",
+	)
+	if n := strings.Count(out, "<br/>"); n != 1 {
+		t.Errorf("expected line breaks only inside the read-aloud block, got %d", n)
+	}
+}
+
+func TestAnnexSectionNumbers(t *testing.T) {
+	out := build(t, "# Rules\n\nANNEX Bestiary\n\n## Orcs\n\nANNEX Tables\n\n## Loot\n\n## Traps\n", BuilderConfig{TableOfContents: true})
+	assertContains(t, out,
+		"<li><strong>Annexe B</strong>: <a href='#annex-tables'>Tables</a></li>\n<ol>\n<li><strong>B.1</strong> - <a href='#loot'>Loot</a></li>\n<li><strong>B.2</strong> - <a href='#traps'>Traps</a></li>\n</ol>\n",
+		"<h3><a name='orcs'></a>A.1 - Orcs</h3>",
+		"<h3><a name='loot'></a>B.1 - Loot</h3>",
+		"<h3><a name='traps'></a>B.2 - Traps</h3>",
+	)
+
+	tests := []struct {
+		annex   int
+		section int
+		number  string
+	}{
+		{annex: 0, section: 0, number: "A.1"},
+		{annex: 0, section: 1, number: "A.2"},
+		{annex: 2, section: 2, number: "C.3"},
+		{annex: 26, section: 0, number: "AA.1"},
+	}
+
+	for _, test := range tests {
+		if number := annexSectionNumber(test.annex, test.section); number != test.number {
+			t.Errorf("annexSectionNumber(%d, %d) = %q, want %q", test.annex, test.section, number, test.number)
+		}
+	}
+}
+
+func TestSeeAlso(t *testing.T) {
+	input := "# Rules\n\n## Combat\n\nRoll dice.\n\\seealso(Magic, rules)\n\n## Magic\n\n\\seealso(Nowhere)\n"
+
+	out := build(t, input, BuilderConfig{})
+	assertContains(t, out, "Roll dice.\n</p>\n<p class='see-also'>Voir aussi : <a href='#magic'>Magic</a>, <a href='#rules'>Rules</a></p>\n")
+	if n := strings.Count(out, "see-also"); n != 1 {
+		t.Errorf("expected a single see-also footer, got %d:\n%s", n, out)
+	}
+	if warnings := lint(t, input, BuilderConfig{}); len(warnings) != 1 || warnings[0] != "seealso: unknown target \"Nowhere\"" {
+		t.Errorf("unexpected warnings %v", warnings)
+	}
+
+	err := buildError(t, input, BuilderConfig{StrictLinks: true})
+	assertContains(t, err, "line 10: seealso: unknown target \"Nowhere\"")
+
+	out = build(t, input, BuilderConfig{Labels: Labels{SeeAlso: "See also:"}})
+	assertContains(t, out, "<p class='see-also'>See also: <a href='#magic'>")
+}
+
+func TestEscapeText(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{name: "text", input: "a < b & c > d\n", want: "a &lt; b &amp; c &gt; d"},
+		{name: "bold", input: "**x<y & z**\n", want: "<strong>x&lt;y &amp; z</strong>"},
+		{name: "em", input: "__a&b <c>__\n", want: "<em>a&amp;b &lt;c&gt;</em>"},
+		{name: "link", input: "[<i>](Rules)\n", want: "<a href='#rules'>&lt;i&gt;</a>"},
+		{name: "list", input: "- item <b> & co\n", want: "<li>\n<p>\nitem &lt;b&gt; &amp; co\n</p>"},
+		{name: "table", input: "-table- T<1>\na&b|**<c>**\n-table-\n", want: "<th colspan='2'>T&lt;1&gt;</th>\n</tr>\n</thead>\n<tbody>\n<tr>\n<td class='head'>a&amp;b</td>\n<td class='head'><strong>&lt;c&gt;</strong></td>"},
+	}
+
+	for _, test := range tests {
+		out := build(t, "# Rules\n\n"+test.input, BuilderConfig{})
+		assertContains(t, out, test.want)
+		assertNotContains(t, out, "<i>", "<b>", "<c>", "<y")
+	}
+
+	out := build(t, "# Rules & <Co>\n\n\\img(a.png, <alt>)\n", BuilderConfig{})
+	assertContains(t, out, "I - Rules &amp; &lt;Co&gt;</h2>", "<img class='illustration' src='a.png' alt='&lt;alt&gt;' />")
+}
+
+func TestTableCaptionOnly(t *testing.T) {
+	out := build(t, "# Rules\n\n-table- Decor & co {caption-only}\na|b\n-table-\n\n-table- Shown\nc|d\n-table-\n", BuilderConfig{})
+	assertContains(t, out,
+		"<table aria-label='Decor &amp; co'>\n<tbody>\n<tr>\n<td class='head'>a</td>",
+		"<th colspan='2'>Shown</th>",
+	)
+	assertNotContains(t, out, "caption-only", "<th colspan='2'>Decor")
+}
+
+func TestFlow(t *testing.T) {
+	out := build(t, "# Rules\n\n\\flow()\n\\node(start, Hit?)\n\\node(dmg, Roll damage)\n\\node(miss, Miss)\n\\edge(start, dmg, yes)\n\\edge(start, miss, no)\n\\end()\n", BuilderConfig{})
+	assertContains(t, out,
+		"<figure class='flow'>\n<ol class='flow-nodes'>\n",
+		"<li class='flow-node' id='flow-1-start'><span class='flow-text'>Hit?</span>\n<ul class='flow-edges'>\n"+
+			"<li><span class='flow-label'>yes</span> → <a href='#flow-1-dmg'>Roll damage</a></li>\n"+
+			"<li><span class='flow-label'>no</span> → <a href='#flow-1-miss'>Miss</a></li>\n</ul>\n</li>\n",
+		"<li class='flow-node' id='flow-1-dmg'><span class='flow-text'>Roll damage</span>\n</li>\n",
+		"<li class='flow-node' id='flow-1-miss'><span class='flow-text'>Miss</span>\n</li>\n</ol>\n</figure>\n",
+	)
+	if n := strings.Count(out, "class='flow-node'"); n != 3 {
+		t.Errorf("expected 3 nodes, got %d", n)
+	}
+
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{input: "\\flow()\n\\node(a, A)\n\\edge(a, b, go)\n\\end()\n", err: "line 5: edge: unknown node \"b\""},
+		{input: "\\flow()\n\\node(a, A)\n\\node(a, B)\n\\end()\n", err: "line 5: node: \"a\" is already defined"},
+		{input: "\\node(a, A)\n", err: "line 3: node: outside of a flow block"},
+		{input: "\\flow()\n\\node(a)\n\\end()\n", err: "line 4: node: expected 2 args (id, text), got 1"},
+	}
+
+	for _, test := range tests {
+		err := buildError(t, "# Rules\n\n"+test.input, BuilderConfig{})
+		assertContains(t, err, test.err)
+	}
+}
+
+func TestGrayscale(t *testing.T) {
+	input := "# Rules\n\nA \\color(hot, #f00, yellow) word.\n\n-table- T\n\\color(cold, blue)|y\n-table-\n"
+
+	out := build(t, input, BuilderConfig{Grayscale: true})
+	if !strings.HasPrefix(out, "<div class='rulebook grayscale'>\n") {
+		t.Errorf("expected the output tagged for grayscale printing:\n%s", out)
+	}
+	assertContains(t, out,
+		"A <strong class='color'>hot</strong> word.",
+		"<td class='head'><strong class='color'>cold</strong></td>",
+	)
+	assertNotContains(t, out, "style=", "#f00", "blue", "yellow")
+
+	out = build(t, input, BuilderConfig{Grayscale: true, Lang: "fr"})
+	assertContains(t, out, "<div class='rulebook grayscale' lang='fr'>")
+
+	out = build(t, input, BuilderConfig{})
+	assertContains(t, out, "<span style='color: #f00; background-color: yellow'>hot</span>")
+	assertNotContains(t, out, "grayscale", "class='color'")
+}
+
+func TestNestedLists(t *testing.T) {
+	compact := strings.NewReplacer("\n", "", "<p>", "", "</p>", "", " class='roman'", "")
+
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "two levels",
+			input: "- a\n  - b\n- c\n",
+			want:  "<ol><li>a<ol><li>b</li></ol></li><li>c</li></ol>",
+		},
+		{
+			name:  "three levels",
+			input: "- a\n  - b\n    - c\n",
+			want:  "<ol><li>a<ol><li>b<ol><li>c</li></ol></li></ol></li></ol>",
+		},
+		{
+			name:  "depth 2 back to 0",
+			input: "- a\n  - b\n    - c\n- d\n",
+			want:  "<ol><li>a<ol><li>b<ol><li>c</li></ol></li></ol></li><li>d</li></ol>",
+		},
+		{
+			name:  "depth 2 back to text",
+			input: "- a\n  - b\n    - c\nText.\n",
+			want:  "<ol><li>a<ol><li>b<ol><li>c</li></ol></li></ol></li></ol>Text.",
+		},
+	}
+
+	for _, test := range tests {
+		out := build(t, "# Rules\n\n"+test.input, BuilderConfig{})
+		out = compact.Replace(out[strings.Index(out, "</h2>")+len("</h2>"):])
+		if out != test.want {
+			t.Errorf("%s:\ngot  %s\nwant %s", test.name, out, test.want)
+		}
+	}
+}
+
+func TestBlockquote(t *testing.T) {
+	out := build(t, "# Rules\n\n> The **dragon** speaks.\n> Still quoted.\n>\n> Second para.\nNormal paragraph.\n", BuilderConfig{})
+	assertContains(t, out, "<blockquote>\n<p>\nThe <strong>dragon</strong> speaks.\nStill quoted.\n</p>\n<p>\nSecond para.\n</p>\n</blockquote>\n<p>\nNormal paragraph.\n</p>\n")
+
+	out = build(t, "# Rules\n\na > b\n", BuilderConfig{})
+	assertNotContains(t, out, "blockquote")
+}
+
+func TestHorizontalRule(t *testing.T) {
+	out := build(t, "# Rules\n\nAbove\n---\nBelow\n\n-table- T\na|b\n-table-\n\n- item\n\n--- not a rule\n", BuilderConfig{})
+	assertContains(t, out,
+		"Above\n</p>\n<hr/>\n<p>\nBelow\n</p>",
+		"<th colspan='2'>T</th>",
+		"<li>\n<p>\nitem\n</p>",
+		"<p>\n--- not a rule\n</p>",
+	)
+	if n := strings.Count(out, "<hr/>"); n != 1 {
+		t.Errorf("expected a single rule, got %d:\n%s", n, out)
+	}
+}
+
+func TestLinks(t *testing.T) {
+	out := build(t, "# Rules\n\nSee [site](https://example.com/a?b=1&c=2), [mail](mailto:gm@example.com), [home](/index.html) and [combat](Combat).\n\n## Combat\n", BuilderConfig{})
+	assertContains(t, out, "See <a href='https://example.com/a?b=1&amp;c=2'>site</a>, <a href='mailto:gm@example.com'>mail</a>, <a href='/index.html'>home</a> and <a href='#combat'>combat</a>.")
+	assertNotContains(t, out, "href='#https", "href='#mailto", "target=")
+
+	out = build(t, "# Rules\n\n[x](https://example.com/?q='a')\n", BuilderConfig{})
+	assertContains(t, out, "<a href='https://example.com/?q=&#39;a&#39;'>x</a>")
+}
+
+func TestLinkFlags(t *testing.T) {
+	out := build(t, "# Rules\n\n[new](https://x.org){blank} [same](https://y.org) [odd](https://z.org){shiny}\n", BuilderConfig{})
+	assertContains(t, out,
+		"<a href='https://x.org' target='_blank' rel='noopener'>new</a>",
+		"<a href='https://y.org'>same</a>",
+		"<a href='https://z.org'>odd</a>",
+	)
+	assertNotContains(t, out, "{blank}", "{shiny}", "shiny")
+	if n := strings.Count(out, "rel='noopener'"); n != 1 {
+		t.Errorf("expected a single new tab link, got %d", n)
+	}
+}
+
+func TestParse(t *testing.T) {
+	document, err := Parse(strings.NewReader("Intro.\n\n# Combat\n\n## Attack\n\nRoll **twice**.\n\\gmonly()\nSecret.\n\\end()\n\nANNEX Bestiary\n"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	if len(document.Chapters) != 1 || document.Chapters[0].Title != "Combat" {
+		t.Fatalf("unexpected chapters %+v", document.Chapters)
+	}
+	if len(document.Chapters[0].Sections) != 1 || document.Chapters[0].Sections[0].Title != "Attack" {
+		t.Fatalf("unexpected sections %+v", document.Chapters[0].Sections)
+	}
+	if len(document.Annexes) != 1 || document.Annexes[0].Title != "Bestiary" {
+		t.Fatalf("unexpected annexes %+v", document.Annexes)
+	}
+	if first := document.Items[0]; first.Type() != ItemText || first.Value() != "Intro." || first.Line() != 1 {
+		t.Errorf("unexpected first item %v", first)
+	}
+
+	text := ""
+	for _, it := range document.Chapters[0].Sections[0].Items {
+		switch it.Type() {
+		case ItemText, ItemBold:
+			text += it.Value()
+		}
+	}
+	if text != "Roll twice.Secret." {
+		t.Errorf("section text = %q", text)
+	}
+
+	if _, err := Parse(strings.NewReader("# Combat\n\n**oops\n")); err == nil || err.Error() != "line 3, column 1: unterminated bold" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestCustomCommands(t *testing.T) {
+	config := BuilderConfig{Commands: map[string]CommandFunc{
+		"badge": func(args []string) (string, error) {
+			if len(args) != 2 {
+				return "", fmt.Errorf("expected 2 args, got %d", len(args))
+			}
+			return fmt.Sprintf("<span class='badge badge-%s'>%s</span>", args[1], args[0]), nil
+		},
+		"img": func(args []string) (string, error) {
+			return "<custom-img/>", nil
+		},
+	}}
+
+	out := build(t, "# Rules\n\nThe \\badge(Elite, gold) orc \\img(orc.png, Orc).\n", config)
+	assertContains(t, out, "The <span class='badge badge-gold'>Elite</span> orc <custom-img/>.")
+	assertNotContains(t, out, "illustration")
+
+	err := buildError(t, "# Rules\n\n\\badge(Elite)\n", config)
+	assertContains(t, err, "line 3: badge: expected 2 args, got 1")
+
+	if warnings := lint(t, "# Rules\n\n\\badge(Elite, gold)\n", config); len(warnings) > 0 {
+		t.Errorf("unexpected warnings %v", warnings)
+	}
+}
+
+func TestUnknownCommands(t *testing.T) {
+	input := "# Rules\n\nA \\imgg(a.png, <b>) typo.\n"
+
+	out := build(t, input, BuilderConfig{})
+	assertContains(t, out, "A \\imgg(a.png, &lt;b&gt;) typo.")
+	if warnings := lint(t, input, BuilderConfig{}); len(warnings) != 1 || warnings[0] != "unknown command \"imgg\"" {
+		t.Errorf("unexpected warnings %v", warnings)
+	}
+
+	err := buildError(t, input, BuilderConfig{StrictCommands: true})
+	assertContains(t, err, "line 3: unknown command \"imgg\"")
+}
+
+func TestImgArgs(t *testing.T) {
+	out := build(t, "# Rules\n\n\\img(orc.png, An orc)\n", BuilderConfig{})
+	assertContains(t, out, "<img class='illustration' src='orc.png' alt='An orc' />")
+
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{input: "\\img(orc.png)", err: "line 5: img: expected at least 2 args (src, alt), got 1"},
+		{input: "\\img()", err: "line 5: img: expected at least 2 args (src, alt), got 0"},
+		{input: "\\img(, An orc)", err: "line 5: img: missing src"},
+	}
+
+	for _, test := range tests {
+		err := buildError(t, "# Rules\n\nText.\n\n"+test.input+"\n", BuilderConfig{})
+		assertContains(t, err, test.err)
+	}
+}
+
+func TestQuotedCommandArgs(t *testing.T) {
+	out := build(t, "# Rules\n\n\\img(cat.png, \"a big, fluffy cat\", left)\n\n\\img(dog.png, \"say \\\"woof\\\", loudly\")\n\n\\img(x.png, a\\, b)\n", BuilderConfig{})
+	assertContains(t, out,
+		"<img class='illustration float-left' src='cat.png' alt='a big, fluffy cat' />",
+		"<img class='illustration' src='dog.png' alt='say &#34;woof&#34;, loudly' />",
+		"<img class='illustration' src='x.png' alt='a, b' />",
+	)
+}
+
+func TestPercentSigns(t *testing.T) {
+	out := build(t, "# Rules 100%\n\nA 50% chance, %s and %d% and **5%** 100%%.\n\n-table- Odds %\n10%|\\color(%x, red)\n-table-\n", BuilderConfig{})
+	assertContains(t, out,
+		"I - Rules 100%</h2>",
+		"A 50% chance, %s and %d% and <strong>5%</strong> 100%%.",
+		"<th colspan='2'>Odds %</th>",
+		"<td class='head'>10%</td>",
+		"<span style='color: red'>%x</span>",
+	)
+	assertNotContains(t, out, "%!", "50%%")
+}
+
+// cancelingReader cancels its context once more than after bytes were read.
+type cancelingReader struct {
+	r      io.Reader
+	read   int
+	after  int
+	cancel context.CancelFunc
+}
+
+func (c *cancelingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.read += n
+	if c.read > c.after {
+		c.cancel()
+	}
+	return n, err
+}
+
+// cancelingWriter cancels its context once it is written to.
+type cancelingWriter struct {
+	strings.Builder
+	cancel context.CancelFunc
+}
+
+func (c *cancelingWriter) Write(p []byte) (int, error) {
+	c.cancel()
+	return c.Builder.Write(p)
+}
+
+func TestBuildContextCancel(t *testing.T) {
+	input := syntheticRulebook(200)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reader := &cancelingReader{r: strings.NewReader(input), after: len(input) / 10, cancel: cancel}
+
+	var out strings.Builder
+	if err := BuildContext(ctx, reader, &out, BuilderConfig{}); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	if reader.read >= len(input) {
+		t.Errorf("read the whole input after the cancellation")
+	}
+	if out.Len() > 0 {
+		t.Errorf("unexpected output after the cancellation")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	if err := BuildContext(ctx, strings.NewReader(input), &out, BuilderConfig{}); err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	if err := BuildContext(context.Background(), strings.NewReader("# Rules\n"), &out, BuilderConfig{}); err != nil {
+		t.Errorf("build: %v", err)
+	}
+}
+
+func TestBuildContextCancelKeepsRenderedOutput(t *testing.T) {
+	input := syntheticRulebook(200)
+	full := build(t, input, BuilderConfig{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := &cancelingWriter{cancel: cancel}
+	if err := BuildContext(ctx, strings.NewReader(input), w, BuilderConfig{}); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+
+	partial := w.String()
+	if partial == "" || len(partial) >= len(full) || !strings.HasPrefix(full, partial) {
+		t.Fatalf("expected a prefix of the output, got %d of %d bytes", len(partial), len(full))
+	}
+	if rest := full[len(partial):]; !strings.HasPrefix(rest, "<h") {
+		t.Errorf("output cut before the next heading: %q", rest[:40])
+	}
+}
+
+func TestBuildReturnsLexError(t *testing.T) {
+	tests := []struct {
+		input string
+		line  int
+	}{
+		{input: "# Rules\n\nText.\n\n-table- Weapons\nName|Damage\nSword|d8\n", line: 5},
+		{input: "---\ntitle: Rules\n---\n# Rules\n\n-table- Weapons\nName|Damage\n", line: 6},
+	}
+
+	for _, test := range tests {
+		err := Build(strings.NewReader(test.input), ioutil.Discard, BuilderConfig{})
+		lexErr, ok := err.(LexError)
+		if !ok {
+			t.Fatalf("expected a LexError, got %T %v", err, err)
+		}
+		if lexErr.Line != test.line || lexErr.Message != "unterminated table" {
+			t.Errorf("unexpected error %+v, want line %d", lexErr, test.line)
+		}
+	}
+}
+
+func TestDanglingLinks(t *testing.T) {
+	input := "# Rules\n\nSee [good](Combat) and [ext](https://x.org).\n\nThen [bad](Nowhere).\n\n## Combat\n"
+
+	warnings, err := Lint(strings.NewReader(input), BuilderConfig{})
+	if err != nil {
+		t.Fatalf("lint: %v", err)
+	}
+	if len(warnings) != 1 || warnings[0].Line != 5 || warnings[0].Message != "link: unknown target \"Nowhere\"" {
+		t.Errorf("unexpected warnings %+v", warnings)
+	}
+
+	out := build(t, input, BuilderConfig{})
+	assertContains(t, out, "<a href='#combat'>good</a>", "<a href='#nowhere'>bad</a>")
+}
+
+func TestDuplicateTitleAnchors(t *testing.T) {
+	out := build(t, "# Rules\n\n## Combat\n\nSee [c](Combat) and [c2](Combat 2).\n\n# Magic\n\n## Combat\n\n## Combat 2\n", BuilderConfig{TableOfContents: true})
+	assertContains(t, out,
+		"<li><a href='#combat'>Combat</a></li>",
+		"<li><a href='#combat-2'>Combat</a></li>",
+		"<li><a href='#combat-2-2'>Combat 2</a></li>",
+		"<h3><a name='combat'></a>Combat</h3>",
+		"<h3><a name='combat-2'></a>Combat</h3>",
+		"<h3><a name='combat-2-2'></a>Combat 2</h3>",
+		"See <a href='#combat'>c</a> and <a href='#combat-2-2'>c2</a>.",
+	)
+
+	anchors := map[string]bool{}
+	for _, anchor := range regexp.MustCompile(`(?:id|name)='([^']*)'`).FindAllStringSubmatch(out, -1) {
+		if anchors[anchor[1]] {
+			t.Errorf("anchor %q is defined twice", anchor[1])
+		}
+		anchors[anchor[1]] = true
+	}
+}
+
+func TestAnchorName(t *testing.T) {
+	tests := []struct {
+		title  string
+		anchor string
+	}{
+		{title: "Préparation du Combat", anchor: "preparation-du-combat"},
+		{title: "L'Équipement !", anchor: "lequipement"},
+		{title: "Ça, c'est l'œuvre à Noël", anchor: "ca-cest-loeuvre-a-noel"},
+		{title: "  Combat -- Attaques  ", anchor: "combat-attaques"},
+		{title: "Niveau 10", anchor: "niveau-10"},
+	}
+
+	for _, test := range tests {
+		if anchor := anchorName(test.title); anchor != test.anchor {
+			t.Errorf("anchorName(%q) = %q, want %q", test.title, anchor, test.anchor)
+		}
+	}
+
+	input := "# Préparation du Combat\n\nSee [gear](L'Equipement !) and [prep](Preparation du combat).\n\n## L'Équipement !\n"
+	out := build(t, input, BuilderConfig{})
+	assertContains(t, out,
+		"<h2><a id='preparation-du-combat'></a>",
+		"<h3><a name='lequipement'></a>L'Équipement !</h3>",
+		"<a href='#lequipement'>gear</a>",
+		"<a href='#preparation-du-combat'>prep</a>",
+	)
+	if warnings := lint(t, input, BuilderConfig{}); len(warnings) > 0 {
+		t.Errorf("unexpected warnings %v", warnings)
+	}
+}
+
+func TestTOCDepth(t *testing.T) {
+	input := "# Rules\n\n## Combat\n\n### Critical Hits\n\nANNEX Bestiary\n\n## Orcs\n"
+
+	tests := []struct {
+		name     string
+		config   BuilderConfig
+		toc      bool
+		sections bool
+		subs     bool
+	}{
+		{name: "no table of contents", config: BuilderConfig{}},
+		{name: "depth 1", config: BuilderConfig{TOCDepth: 1}, toc: true},
+		{name: "depth 2", config: BuilderConfig{TOCDepth: 2}, toc: true, sections: true},
+		{name: "depth 3", config: BuilderConfig{TOCDepth: 3}, toc: true, sections: true, subs: true},
+		{name: "table of contents", config: BuilderConfig{TableOfContents: true}, toc: true, sections: true},
+		{name: "table of contents with sub-sections", config: BuilderConfig{TableOfContents: true, TOCSubSections: true}, toc: true, sections: true, subs: true},
+	}
+
+	for _, test := range tests {
+		out := build(t, input, test.config)
+		for _, check := range []struct {
+			want bool
+			s    string
+		}{
+			{want: test.toc, s: "<div id='summary'>"},
+			{want: test.toc, s: "<a href='#rules'>Rules</a>"},
+			{want: test.toc, s: "<a href='#annex-bestiary'>Bestiary</a>"},
+			{want: test.sections, s: "<a href='#combat'>Combat</a>"},
+			{want: test.sections, s: "<a href='#orcs'>Orcs</a>"},
+			{want: test.subs, s: "<a href='#critical-hits'>Critical Hits</a>"},
+		} {
+			if strings.Contains(out, check.s) != check.want {
+				t.Errorf("%s: expected %q present %v:\n%s", test.name, check.s, check.want, out)
+			}
+		}
+		assertContains(t, out, "<h4><a name='critical-hits'></a>Critical Hits</h4>", "<h3><a name='orcs'></a>A.1 - Orcs</h3>")
+	}
+}
+
+func TestLabels(t *testing.T) {
+	input := "# Rules\n\n\\attribution(CC-BY Ana)\n\nANNEX Bestiary\n"
+
+	out := build(t, input, BuilderConfig{TableOfContents: true, Labels: Labels{TableOfContents: "Table of Contents", Annex: "Appendix", Licenses: "Licenses"}})
+	assertContains(t, out,
+		"<h3>Table of Contents</h3>",
+		"<li><strong>Appendix A</strong>: <a href='#annex-bestiary'>Bestiary</a></li>",
+		"Appendix A: Bestiary</h2>",
+		"<h2>Licenses</h2>",
+	)
+	assertNotContains(t, out, "Table des matières", "Annexe", "Licences")
+
+	out = build(t, input, BuilderConfig{TableOfContents: true})
+	assertContains(t, out, "<h3>Table des matières</h3>", "<strong>Annexe A</strong>", "Annexe A: Bestiary</h2>", "<h2>Licences</h2>")
+
+	var text strings.Builder
+	if err := BuildText(strings.NewReader(input), &text, BuilderConfig{Labels: Labels{Annex: "Appendix"}}); err != nil {
+		t.Fatalf("text: %v", err)
+	}
+	assertContains(t, text.String(), "Appendix A: Bestiary")
+}
+
+func TestNumberSections(t *testing.T) {
+	input := "# Rules\n\n## Move\n\n## Attack\n\n# Magic\n\n## Spells\n"
+
+	out := build(t, input, BuilderConfig{TableOfContents: true, NumberSections: true})
+	assertContains(t, out,
+		"<li><strong>I.1</strong> - <a href='#move'>Move</a></li>",
+		"<li><strong>I.2</strong> - <a href='#attack'>Attack</a></li>",
+		"<li><strong>II.1</strong> - <a href='#spells'>Spells</a></li>",
+		"<h3><a name='move'></a>I.1 - Move</h3>",
+		"<h3><a name='attack'></a>I.2 - Attack</h3>",
+		"<h3><a name='spells'></a>II.1 - Spells</h3>",
+	)
+	assertNotContains(t, out, "II.3", "I.3")
+
+	out = build(t, input, BuilderConfig{TableOfContents: true})
+	assertContains(t, out, "<li><a href='#move'>Move</a></li>", "<h3><a name='move'></a>Move</h3>")
+	assertNotContains(t, out, "I.1")
+}
+
+func TestBaseHeadingLevel(t *testing.T) {
+	input := "# Rules\n\n## Combat\n\n### Critical Hits\n\nANNEX Bestiary\n"
+
+	out := build(t, input, BuilderConfig{BaseHeadingLevel: 3})
+	assertContains(t, out,
+		"<h3><a id='rules'></a>I - Rules</h3>",
+		"<h4><a name='combat'></a>Combat</h4>",
+		"<h5><a name='critical-hits'></a>Critical Hits</h5>",
+		"<h3><a name='annex-bestiary'></a>Annexe A: Bestiary</h3>",
+	)
+	assertNotContains(t, out, "<h2")
+
+	out = build(t, input, BuilderConfig{BaseHeadingLevel: 6})
+	assertContains(t, out, "<h6><a id='rules'></a>", "<h6><a name='combat'></a>", "<h6><a name='critical-hits'></a>")
+
+	out = build(t, input, BuilderConfig{BaseHeadingLevel: -2})
+	assertContains(t, out, "<h1><a id='rules'></a>", "<h2><a name='combat'></a>", "<h3><a name='critical-hits'></a>")
+}
+
+func TestStandalone(t *testing.T) {
+	input := "# Rules\n\nText.\n"
+	config := BuilderConfig{Standalone: true, Title: "My <Book>", StylesheetHref: "css/rules.css?a=1&b=2"}
+
+	out := build(t, input, config)
+	if !strings.HasPrefix(out, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset='utf-8'>\n") || !strings.HasSuffix(out, "</body>\n</html>\n") {
+		t.Errorf("expected a complete document:\n%s", out)
+	}
+	assertContains(t, out,
+		"<title>My &lt;Book&gt;</title>\n<link rel='stylesheet' href='css/rules.css?a=1&amp;b=2'>\n</head>\n<body>\n<h2><a id='rules'></a>I - Rules</h2>",
+	)
+
+	config.Standalone = false
+	out = build(t, input, config)
+	assertNotContains(t, out, "<!DOCTYPE", "<html", "<head>", "<body>", "stylesheet", "<title>")
+}
+
+func TestFigures(t *testing.T) {
+	out := build(t, "# Rules\n\n\\figure(map.png, The map, with <roads>)\n\nText.\n\n\\figure(orc.png, An orc)\n", BuilderConfig{})
+	assertContains(t, out,
+		"<figure id='figure-1'>\n<img src='map.png' alt='The map, with &lt;roads&gt;'/>\n<figcaption>Figure 1: The map, with &lt;roads&gt;</figcaption>\n</figure>\n",
+		"<figure id='figure-2'>\n<img src='orc.png' alt='An orc'/>\n<figcaption>Figure 2: An orc</figcaption>\n</figure>\n",
+	)
+
+	out = build(t, "# Rules\n\n\\figure(orc.png, An orc)\n", BuilderConfig{Labels: Labels{Figure: "Fig."}})
+	assertContains(t, out, "<figcaption>Fig. 1: An orc</figcaption>")
+
+	err := buildError(t, "# Rules\n\n\\figure(orc.png)\n", BuilderConfig{})
+	assertContains(t, err, "line 3: figure: expected 2 args (src, caption), got 1")
+}
+
+func TestAdmonitions(t *testing.T) {
+	out := build(t, "# Rules\n\n\\begin(note)\nRemember:\n\n- one\n- two\n\\end(note)\n\nAfter.\n", BuilderConfig{})
+	assertContains(t, out, "<aside class='note'>\n<p class='indent'>\nRemember:\n</p>\n<ol class='roman'>\n")
+	assertContains(t, out, "</ol>\n\n</aside>\n<p>\nAfter.\n</p>")
+
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{input: "\\begin(note)\n\\begin(tip)\nx\n\\end(tip)\n\\end(note)\n", err: "line 4: begin: tip inside note"},
+		{input: "\\begin(note)\nx\n\\end(warning)\n", err: "line 5: end: \"warning\" closes the \"note\" block"},
+		{input: "\\begin(shout)\nx\n\\end(shout)\n", err: "line 3: begin: expected one of note, warning, tip or example, got \"shout\""},
+		{input: "x\n\\end(note)\n", err: "line 4: end: no open block"},
+	}
+
+	for _, test := range tests {
+		err := buildError(t, "# Rules\n\n"+test.input, BuilderConfig{})
+		assertContains(t, err, test.err)
+	}
+}
+
+func TestDefinitionLists(t *testing.T) {
+	out := build(t, "# Rules\n\nArmor\n: Protects **you**.\n*Speed*\n: How far you move.\n", BuilderConfig{})
+	assertContains(t, out, "<dl>\n<dt>Armor</dt>\n<dd>Protects <strong>you</strong>.</dd>\n<dt><i>Speed</i></dt>\n<dd>How far you move.</dd>\n</dl>\n")
+
+	out = build(t, "# Rules\n\nSpeed\n: How far you move.\n: Measured in feet.\n", BuilderConfig{})
+	assertContains(t, out, "<dl>\n<dt>Speed</dt>\n<dd>How far you move.</dd>\n<dd>Measured in feet.</dd>\n</dl>\n")
+}
+
+func TestMark(t *testing.T) {
+	out := build(t, "# Rules\n\nThe ==most important== rule: ==a < b==.\n", BuilderConfig{})
+	assertContains(t, out, "<p class='indent'>\nThe <mark>most important</mark> rule: <mark>a &lt; b</mark>.\n</p>")
+
+	out = build(t, "# Rules\n\n==Always== roll.\n", BuilderConfig{})
+	assertContains(t, out, "<p class='indent'>\n<mark>Always</mark> roll.\n</p>")
+}
+
+func TestDice(t *testing.T) {
+	out := build(t, "# Rules\n\nRoll \\dice(2d6+1), then \\dice(d%).\n", BuilderConfig{})
+	assertContains(t, out, "Roll <span class='dice' data-dice='2d6+1'>2d6+1</span>, then <span class='dice' data-dice='d%'>d%</span>.")
+
+	err := buildError(t, "# Rules\n\nRoll \\dice(2x6).\n", BuilderConfig{})
+	assertContains(t, err, "line 3: dice: invalid dice \"2x6\"")
+}
+
+func TestStatBlock(t *testing.T) {
+	out := build(t, "# Rules\n\n\\statblock(Orc <chief>, 15, 13, 30 ft)\n", BuilderConfig{})
+	assertContains(t, out, "<div class='statblock'>\n<div class='statblock-name'>Orc &lt;chief&gt;</div>\n<dl>\n"+
+		"<dt>Points de vie</dt><dd>15</dd>\n<dt>Classe d'armure</dt><dd>13</dd>\n<dt>Vitesse</dt><dd>30 ft</dd>\n</dl>\n</div>\n")
+
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{input: "\\statblock(Orc, 15, 13)", err: "line 3: statblock: expected 4 args (name, hp, ac, speed), got 3"},
+		{input: "\\statblock(Orc, , 13, 30)", err: "line 3: statblock: missing hp"},
+	}
+
+	for _, test := range tests {
+		err := buildError(t, "# Rules\n\n"+test.input+"\n", BuilderConfig{})
+		assertContains(t, err, test.err)
+	}
+}
+
+func TestTableCellMarkup(t *testing.T) {
+	out := build(t, "# Combat\n\n-table- Weapons\nName|Damage\n**Sword**|d8 \\| d10\n[Axe](combat)|<d6>\n-table-\n", BuilderConfig{})
+	assertContains(t, out,
+		"<td class='head'><strong>Sword</strong></td>\n<td class='lead'>d8 | d10</td>",
+		"<td class='head'><a href='#combat'>Axe</a></td>\n<td class='lead'>&lt;d6&gt;</td>",
+	)
+}
+
+func TestRaggedTable(t *testing.T) {
+	warnings, err := Lint(strings.NewReader("# Rules\n\n-table- Weapons\nName|Damage|Cost\nSword|d8\nAxe|d6\n-table-\n"), BuilderConfig{})
+	if err != nil {
+		t.Fatalf("lint: %v", err)
+	}
+
+	if len(warnings) != 1 {
+		t.Fatalf("expected 1 warning, got %v", warnings)
+	}
+	if w := warnings[0]; w.Line != 5 || w.Message != "table \"Weapons\": row of 2 cells, expected 3" {
+		t.Errorf("unexpected warning %+v", w)
+	}
+}
+
+func TestEmptyTable(t *testing.T) {
+	for _, input := range []string{"-table- Weapons -table-\n", "-table- Weapons\n-table-\n"} {
+		out := build(t, "# Rules\n\n"+input+"\nAfter.\n", BuilderConfig{})
+		assertContains(t, out, "<table>\n<thead>\n<tr>\n<th colspan='1'>Weapons</th>\n</tr>\n</thead>\n<tbody>\n</tbody>\n</table>\n<p>\nAfter.\n</p>")
+
+		want := []string{"table \"Weapons\": no rows"}
+		if warnings := lint(t, "# Rules\n\n"+input, BuilderConfig{}); !reflect.DeepEqual(warnings, want) {
+			t.Errorf("%q: got warnings %v, want %v", input, warnings, want)
+		}
+	}
+}
+
+func TestTableCaption(t *testing.T) {
+	input := "# Rules\n\n-table- Weapons & co\nName|Damage\nSword|d8\n-table-\n"
+
+	out := build(t, input, BuilderConfig{TableCaption: true})
+	assertContains(t, out, "<table>\n<caption>Weapons &amp; co</caption>\n<tbody>\n<tr>\n<td class='head'>Name</td>")
+	assertNotContains(t, out, "<thead>", "colspan")
+
+	out = build(t, input, BuilderConfig{})
+	assertContains(t, out, "<table>\n<thead>\n<tr>\n<th colspan='2'>Weapons &amp; co</th>\n</tr>\n</thead>\n<tbody>\n")
+	assertNotContains(t, out, "<caption>")
+}
+
+func TestCommandsInListItems(t *testing.T) {
+	out := build(t, "# Combat\n\n- See \\img(orc.png, An orc) and [Combat](combat) now.\n- \\color(hot, red) item\n", BuilderConfig{})
+	assertContains(t, out,
+		"<li>\n<p>\nSee \n</p>\n<img class='illustration' src='orc.png' alt='An orc' /><p>\n and <a href='#combat'>Combat</a> now.\n</p>\n",
+		"<li>\n<p>\n<span style='color: red'>hot</span> item\n</p>\n",
+	)
+}
+
+func TestCommandsInTableCells(t *testing.T) {
+	out := build(t, "# Combat\n\n-table- Weapons\nName|Damage\n\\color(Fire, red)|[see](combat)\n\\img(a.png, A)|x\n-table-\n", BuilderConfig{})
+	assertContains(t, out,
+		"<td class='head'><span style='color: red'>Fire</span></td>\n<td class='lead'><a href='#combat'>see</a></td>",
+		"<td class='head'><img class='illustration' src='a.png' alt='A' /></td>",
+	)
+}
+
+func TestImageSize(t *testing.T) {
+	tests := []struct {
+		size  string
+		attrs string
+	}{
+		{size: "w300", attrs: " width='300'"},
+		{size: "h200", attrs: " height='200'"},
+		{size: "w300h200", attrs: " width='300' height='200'"},
+		{size: "h200w300", attrs: " width='300' height='200'"},
+	}
+
+	for _, test := range tests {
+		out := build(t, "# Rules\n\n\\img(a.png, A, center, "+test.size+")\n", BuilderConfig{})
+		assertContains(t, out, "<img class='illustration' src='a.png' alt='A'"+test.attrs+"/>")
+	}
+}
+
+func TestLazyImages(t *testing.T) {
+	input := "# Rules\n\n\\img(a.png, A)\n\n\\figure(b.png, B)\n"
+
+	out := build(t, input, BuilderConfig{LazyImages: true})
+	assertContains(t, out,
+		"<img class='illustration' src='a.png' alt='A' loading='lazy' decoding='async'/>",
+		"<img src='b.png' alt='B' loading='lazy' decoding='async'/>",
+	)
+
+	out = build(t, input, BuilderConfig{})
+	assertNotContains(t, out, "loading=", "decoding=")
+}
+
+func TestImageSrcset(t *testing.T) {
+	out := build(t, "# Rules\n\n\\img(a.png, A, center, w400, \"a-2x.png 2x, a'3x.png 3x\")\n", BuilderConfig{})
+	assertContains(t, out, "<img class='illustration' src='a.png' alt='A' width='400' srcset='a-2x.png 2x, a&#39;3x.png 3x'/>")
+}
+
+func TestVideo(t *testing.T) {
+	tests := []struct {
+		args  string
+		video string
+	}{
+		{args: "a.mp4, p.jpg", video: "<video controls poster='p.jpg'>\n<source src='a.mp4' type='video/mp4'>\n</video>\n"},
+		{args: "a.webm", video: "<video controls>\n<source src='a.webm' type='video/webm'>\n</video>\n"},
+		{args: "a.mp4, ", video: "<video controls>\n<source src='a.mp4' type='video/mp4'>\n</video>\n"},
+	}
+
+	for _, test := range tests {
+		out := build(t, "# Rules\n\nWatch \\video("+test.args+") now.\n", BuilderConfig{})
+		assertContains(t, out, "<p class='indent'>\nWatch \n</p>\n"+test.video+"<p>\n now.\n</p>")
+	}
+
+	err := buildError(t, "# Rules\n\n\\video()\n", BuilderConfig{})
+	assertContains(t, err, "line 3: video: expected 1 or 2 args (src, poster), got 0")
+}
+
+func TestLinkToAnnex(t *testing.T) {
+	input := "# Combat\n\nSee [z](Z) and [orcs](annex-bestiary).\n\n\\seealso(Z)\n\nANNEX Z\n\nANNEX Bestiary\n"
+
+	out := build(t, input, BuilderConfig{StrictLinks: true})
+	assertContains(t, out,
+		"See <a href='#annex-z'>z</a> and <a href='#annex-bestiary'>orcs</a>.",
+		"<a href='#annex-z'>Z</a></p>",
+		"<h2><a name='annex-z'></a>Annexe A: Z</h2>",
+	)
+	if warnings := lint(t, input, BuilderConfig{}); len(warnings) > 0 {
+		t.Errorf("unexpected warnings: %v", warnings)
+	}
+
+	out = build(t, "# Z\n\nSee [z](Z).\n\nANNEX Z\n", BuilderConfig{})
+	assertContains(t, out, "See <a href='#z'>z</a>.")
+}
+
+func TestBlockOpenAtDocumentEnd(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{name: "note", input: "\\begin(note)\nRemember.\n"},
+		{name: "faq", input: "\\faq()\n\\q(Q)\n\\a()\nA\n"},
+		{name: "flow", input: "\\flow()\n\\node(start, Start)\n"},
+		{name: "gmonly", input: "\\gmonly()\nsecret\n"},
+	}
+
+	for _, test := range tests {
+		err := buildError(t, "# Rules\n\n"+test.input, BuilderConfig{Edition: "gm"})
+		assertContains(t, err, test.name+": block opened on line 3 is not closed at the end of the document")
+	}
+}
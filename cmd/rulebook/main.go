@@ -8,7 +8,7 @@ import (
 )
 
 func main() {
-	err := rulebook.Build(os.Stdin, os.Stdout, rulebook.BuilderConfig{true})
+	err := rulebook.Build(os.Stdin, os.Stdout, rulebook.BuilderConfig{TableOfContents: true})
 	if err != nil {
 		fmt.Println(err)
 	}
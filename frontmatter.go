@@ -0,0 +1,71 @@
+package rulebook
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+const frontMatterFence = "---"
+
+// maxFrontMatter bounds how much of the input is held back looking for the
+// end of a front matter block.
+const maxFrontMatter = lookahead
+
+// readFrontMatter reads the key: value lines of the ----fenced block opening
+// input, if any, returning them with the rest of the input and the number of
+// lines the block took. A block holding anything but blank and key: value
+// lines, none of the latter, or never closed within maxFrontMatter bytes is
+// left in the input: it is body text opening with a rule.
+func readFrontMatter(input io.Reader) (map[string]string, io.Reader, int, error) {
+	reader := bufio.NewReader(input)
+
+	first, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, nil, 0, err
+	}
+	if strings.TrimSpace(first) != frontMatterFence || err == io.EOF {
+		return nil, io.MultiReader(strings.NewReader(first), reader), 0, nil
+	}
+
+	read := []string{first}
+	size := len(first)
+	meta := map[string]string{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, nil, 0, err
+		}
+		read = append(read, line)
+		size += len(line)
+
+		if strings.TrimSpace(line) == frontMatterFence && len(meta) > 0 {
+			return meta, reader, len(read), nil
+		}
+
+		key, value, ok := frontMatterLine(line)
+		if ok {
+			meta[key] = value
+		}
+
+		if err == io.EOF || size > maxFrontMatter || (!ok && strings.TrimSpace(line) != "") {
+			return nil, io.MultiReader(strings.NewReader(strings.Join(read, "")), reader), 0, nil
+		}
+	}
+}
+
+// frontMatterLine splits a key: value line, keys being made of letters,
+// digits, hyphens and underscores.
+func frontMatterLine(line string) (string, string, bool) {
+	colon := strings.Index(line, ":")
+	if colon < 0 {
+		return "", "", false
+	}
+
+	key := strings.TrimSpace(line[:colon])
+	if !isClassName(key) {
+		return "", "", false
+	}
+
+	return strings.ToLower(key), strings.TrimSpace(line[colon+1:]), true
+}
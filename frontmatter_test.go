@@ -0,0 +1,87 @@
+package rulebook
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFrontMatter(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		meta  map[string]string
+		body  string
+	}{
+		{
+			name:  "present",
+			input: "---\ntitle: Règles du jeu\nAuthor: Ana\n\ndate: 2024-05-01\n---\n# Combat\n",
+			meta:  map[string]string{"title": "Règles du jeu", "author": "Ana", "date": "2024-05-01"},
+			body:  "# Combat\n",
+		},
+		{
+			name:  "absent",
+			input: "# Combat\n",
+			body:  "# Combat\n",
+		},
+		{
+			name:  "unterminated",
+			input: "---\ntitle: Règles\n# Combat\n",
+			body:  "---\ntitle: Règles\n# Combat\n",
+		},
+		{
+			name:  "rule with a colon",
+			input: "---\nAn intro: with colon\n---\n# Combat\n",
+			body:  "---\nAn intro: with colon\n---\n# Combat\n",
+		},
+		{
+			name:  "rule with key lines and text",
+			input: "---\nnote: first\nThen some text.\n---\n# Combat\n",
+			body:  "---\nnote: first\nThen some text.\n---\n# Combat\n",
+		},
+		{
+			name:  "two rules",
+			input: "---\n---\n# Combat\n",
+			body:  "---\n---\n# Combat\n",
+		},
+		{
+			name:  "too long",
+			input: "---\n" + strings.Repeat("key: value\n", maxFrontMatter/10) + "---\n# Combat\n",
+			body:  "---\n" + strings.Repeat("key: value\n", maxFrontMatter/10) + "---\n# Combat\n",
+		},
+	}
+
+	for _, test := range tests {
+		meta, rest, lines, err := readFrontMatter(strings.NewReader(test.input))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		body, err := ioutil.ReadAll(rest)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		if !reflect.DeepEqual(meta, test.meta) && (len(meta) > 0 || len(test.meta) > 0) {
+			t.Errorf("%s: meta = %v, want %v", test.name, meta, test.meta)
+		}
+		if string(body) != test.body {
+			t.Errorf("%s: body = %q, want %q", test.name, string(body), test.body)
+		}
+		if want := strings.Count(test.input, "\n") - strings.Count(test.body, "\n"); lines != want {
+			t.Errorf("%s: lines = %d, want %d", test.name, lines, want)
+		}
+	}
+}
+
+func TestFrontMatterStandalone(t *testing.T) {
+	out := build(t, "---\ntitle: Règles\nauthor: Ana\ndate: 2024\n---\n# Combat\n\nText.\n", BuilderConfig{Standalone: true})
+	assertContains(t, out, "<title>Règles</title>", "<p class='byline'>Ana, 2024</p>", "Combat")
+	assertNotContains(t, out, "title:")
+}
+
+func TestFrontMatterKeepsLines(t *testing.T) {
+	err := buildError(t, "---\ntitle: Règles\n---\n# Combat\n\n\\color(x)\n", BuilderConfig{})
+	assertContains(t, err, "line 6")
+}
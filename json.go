@@ -0,0 +1,43 @@
+package rulebook
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type jsonItem struct {
+	Type  ItemType `json:"type"`
+	Value string   `json:"value"`
+	Line  int      `json:"line"`
+}
+
+func (item Item) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonItem{Type: item.typ, Value: item.val, Line: item.line})
+}
+
+func (item *Item) UnmarshalJSON(data []byte) error {
+	var decoded jsonItem
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	*item = Item{typ: decoded.Type, val: decoded.Value, line: decoded.Line}
+
+	return nil
+}
+
+// MarshalText writes token types by name, as String does.
+func (itype ItemType) MarshalText() ([]byte, error) {
+	return []byte(itype.String()), nil
+}
+
+func (itype *ItemType) UnmarshalText(text []byte) error {
+	for t := ItemError; t <= ItemEOF; t++ {
+		if t.String() == string(text) {
+			*itype = t
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown item type %q", text)
+}
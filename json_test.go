@@ -0,0 +1,56 @@
+package rulebook
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDocumentJSON(t *testing.T) {
+	document, err := Parse(strings.NewReader("# Combat\n\n## Attack\n\nRoll **twice**.\n"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	data, err := json.Marshal(document)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	want := `{"items":[],"sections":[],"chapters":[{"title":"Combat",` +
+		`"items":[{"type":"NewLine","value":"","line":1},{"type":"NewLine","value":"","line":2}],` +
+		`"sections":[{"title":"Attack","items":[{"type":"NewLine","value":"","line":3},{"type":"NewLine","value":"","line":4},` +
+		`{"type":"Text","value":"Roll ","line":5},{"type":"Bold","value":"twice","line":5},{"type":"Text","value":".","line":5},` +
+		`{"type":"NewLine","value":"","line":5}]}]}],"annexes":[]}`
+	if string(data) != want {
+		t.Errorf("marshal:\ngot  %s\nwant %s", data, want)
+	}
+
+	var decoded Document
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, document) {
+		t.Errorf("round trip:\ngot  %+v\nwant %+v", decoded, document)
+	}
+}
+
+func TestItemTypeJSON(t *testing.T) {
+	for typ := ItemError; typ <= ItemEOF; typ++ {
+		text, err := typ.MarshalText()
+		if err != nil {
+			t.Fatalf("%d: %v", typ, err)
+		}
+
+		var decoded ItemType
+		if err := decoded.UnmarshalText(text); err != nil || decoded != typ {
+			t.Errorf("%s: round trip gave %d, %v", text, decoded, err)
+		}
+	}
+
+	var typ ItemType
+	if err := typ.UnmarshalText([]byte("Nope")); err == nil {
+		t.Errorf("expected an error for an unknown type")
+	}
+}
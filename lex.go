@@ -1,52 +1,82 @@
 package rulebook
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"strings"
 	"unicode/utf8"
 )
 
-type itemType uint8
+type ItemType uint8
 
 const (
 	doubleNewLine = "\n\n"
 	newLine       = "\n"
 	chapter       = "#"
 	boldRune      = '*'
+	boldSymbol    = "**"
 	emSymbol      = "__"
+	strikeSymbol  = "~~"
+	markSymbol    = "=="
+	supRune       = '^'
+	subRune       = '~'
+	codeRune      = '`'
+	codeFence     = "```"
 	section       = "##"
+	subSection    = "###"
 	table         = "-table-"
 	annex         = "ANNEX"
 	listElement   = "\n- "
+	definition    = ": "
+	quote         = "> "
+	rule          = "---"
 	link          = "["
 	cmdStart      = '\\'
+	escapable     = "*[\\_`~^=|"
 	eof           = 0
 )
 
 const (
-	itemError itemType = iota
-
-	itemText
-	itemBold
-	itemEm
-	itemNewLine
-	itemChapter
-	itemSection
-	itemAnnex
-	itemStartListElement
-	itemEndListElement
-	itemListOpen
-	itemLink
-	itemCommand
-	itemListClose
-	itemTableStart
-	itemTableEnd
-	itemTableRow
-	itemEOF
+	ItemError ItemType = iota
+
+	ItemText
+	ItemBold
+	ItemItalic
+	ItemEm
+	ItemStrike
+	ItemNewLine
+	ItemChapter
+	ItemSection
+	ItemSubSection
+	ItemAnnex
+	ItemStartListElement
+	ItemEndListElement
+	ItemListOpen
+	ItemLink
+	ItemCommand
+	ItemListClose
+	ItemTableStart
+	ItemTableEnd
+	ItemTableRow
+	ItemCode
+	ItemCodeBlock
+	ItemQuoteOpen
+	ItemQuoteClose
+	ItemRule
+	ItemDefListOpen
+	ItemDefTerm
+	ItemDefDesc
+	ItemDefListClose
+	ItemSup
+	ItemSub
+	ItemMark
+	ItemTableAlign
+	ItemEOF
 )
 
-type item struct {
-	typ  itemType
+type Item struct {
+	typ  ItemType
 	val  string
 	line int
 }
@@ -54,73 +84,167 @@ type item struct {
 type stateFn func(*lexer) stateFn
 
 type lexer struct {
-	input string // the string being scanned.
-	start int    // start position of this item.
-	pos   int    // current position in the input.
-	width int    // width of last rune read from input.
-	line  int
-	items chan item // channel of scanned items.
-	state stateFn
+	input   string // the buffered part of the input being scanned.
+	start   int    // start position of this item.
+	pos     int    // current position in the input.
+	width   int    // width of last rune read from input.
+	line    int
+	column  int       // column of the next rune, counted in runes from 1.
+	prevCol int       // column before the last newline, for backup.
+	items   chan Item // channel of scanned items.
+	indents []int     // indentation of the open list levels.
+	state   stateFn
+	reader  *bufio.Reader // rest of the input, nil once read.
+	buf     []byte
+	err     error // read or syntax error, if any.
 }
 
-func (itype itemType) String() string {
+func (itype ItemType) String() string {
 	switch itype {
-	case itemError:
+	case ItemError:
 		return "Error"
-	case itemEOF:
+	case ItemEOF:
 		return "EOF"
-	case itemText:
+	case ItemText:
 		return "Text"
-	case itemEm:
+	case ItemEm:
 		return "Em"
-	case itemBold:
+	case ItemStrike:
+		return "Strike"
+	case ItemBold:
 		return "Bold"
-	case itemSection:
+	case ItemItalic:
+		return "Italic"
+	case ItemSection:
 		return "Section"
-	case itemChapter:
+	case ItemSubSection:
+		return "SubSection"
+	case ItemChapter:
 		return "Chapter"
-	case itemAnnex:
+	case ItemAnnex:
 		return "Annex"
-	case itemLink:
+	case ItemLink:
 		return "Link"
-	case itemCommand:
+	case ItemCommand:
 		return "Command"
-	case itemNewLine:
+	case ItemNewLine:
 		return "NewLine"
-	case itemStartListElement:
+	case ItemStartListElement:
 		return "StartListElement"
-	case itemEndListElement:
+	case ItemEndListElement:
 		return "EndListElement"
-	case itemListOpen:
+	case ItemListOpen:
 		return "ListOpen"
-	case itemListClose:
+	case ItemListClose:
 		return "ListClose"
-	case itemTableStart:
+	case ItemTableStart:
 		return "TableStart"
-	case itemTableEnd:
+	case ItemTableEnd:
 		return "TableEnd"
-	case itemTableRow:
+	case ItemTableRow:
 		return "TableRow"
+	case ItemCode:
+		return "Code"
+	case ItemCodeBlock:
+		return "CodeBlock"
+	case ItemQuoteOpen:
+		return "QuoteOpen"
+	case ItemQuoteClose:
+		return "QuoteClose"
+	case ItemRule:
+		return "Rule"
+	case ItemDefListOpen:
+		return "DefListOpen"
+	case ItemDefTerm:
+		return "DefTerm"
+	case ItemDefDesc:
+		return "DefDesc"
+	case ItemDefListClose:
+		return "DefListClose"
+	case ItemSup:
+		return "Sup"
+	case ItemSub:
+		return "Sub"
+	case ItemMark:
+		return "Mark"
+	case ItemTableAlign:
+		return "TableAlign"
 	}
 	panic(fmt.Sprintf("BUG: Unknown type '%d'.", int(itype)))
 }
 
-func (item item) String() string {
+func (item Item) Type() ItemType {
+	return item.typ
+}
+
+func (item Item) Value() string {
+	return item.val
+}
+
+func (item Item) Line() int {
+	return item.line
+}
+
+func (item Item) String() string {
 	return fmt.Sprintf("%s: %s (line %v)", item.typ.String(), item.val, item.line)
 }
 
-func lex(input string) *lexer {
+// lookahead is how much of the input past the current position is kept
+// buffered, enough for every prefix the state functions check.
+const lookahead = 4096
+
+func lex(input io.Reader) *lexer {
 	l := &lexer{
-		input: input,
-		state: lexText,
-		line:  1,
-		items: make(chan item, 3),
+		state:  lexText,
+		line:   1,
+		column: 1,
+		items:  make(chan Item, 3),
+		reader: bufio.NewReader(input),
+		buf:    make([]byte, lookahead),
 	}
+	l.fill()
 
 	return l
 }
 
-func (l *lexer) nextItem() item {
+// lexString lexes input already in memory, without a buffer to fill.
+func lexString(input string) *lexer {
+	return &lexer{
+		state:  lexText,
+		line:   1,
+		column: 1,
+		items:  make(chan Item, 3),
+		input:  input,
+	}
+}
+
+// fill reads more input once less than lookahead bytes are left past pos.
+// The current item and the byte before it, for line start checks, are kept
+// while the rest of what was scanned is dropped.
+func (l *lexer) fill() {
+	if l.reader == nil || len(l.input)-l.pos >= lookahead {
+		return
+	}
+
+	keep := l.start
+	if keep > 0 {
+		keep--
+	}
+
+	n, err := io.ReadFull(l.reader, l.buf)
+	l.input = l.input[keep:] + string(l.buf[:n])
+	l.start -= keep
+	l.pos -= keep
+
+	if err != nil {
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			l.err = err
+		}
+		l.reader = nil
+	}
+}
+
+func (l *lexer) nextItem() Item {
 	for {
 		select {
 		case item := <-l.items:
@@ -131,30 +255,50 @@ func (l *lexer) nextItem() item {
 	}
 }
 
-func (l *lexer) emit(t itemType) {
-	l.items <- item{t, l.input[l.start:l.pos], l.line}
+func (l *lexer) emit(t ItemType) {
+	l.items <- Item{t, l.input[l.start:l.pos], l.line}
 	l.start = l.pos
 }
 
-func (l *lexer) emitCustom(t itemType, data string) {
-	l.items <- item{t, data, l.line}
+func (l *lexer) emitCustom(t ItemType, data string) {
+	l.items <- Item{t, data, l.line}
 }
 
-func (l *lexer) emitTrim(typ itemType) {
-	l.items <- item{typ, strings.TrimSpace(l.input[l.start:l.pos]), l.line}
+func (l *lexer) emitTrim(typ ItemType) {
+	l.items <- Item{typ, strings.TrimSpace(l.input[l.start:l.pos]), l.line}
 	l.start = l.pos
 }
 
-func (l *lexer) errorf(format string, values ...interface{}) stateFn {
-	l.items <- item{
-		itemError,
-		fmt.Sprintf(format, values...),
-		l.line,
+// errorf stops the lexer with an error about the construct starting at line
+// and column.
+func (l *lexer) errorf(line int, column int, format string, values ...interface{}) stateFn {
+	l.err = LexError{Line: line, Column: column, Message: fmt.Sprintf(format, values...)}
+	l.items <- Item{
+		ItemError,
+		l.err.Error(),
+		line,
 	}
 
 	return nil
 }
 
+// skip moves past n bytes holding no newline.
+func (l *lexer) skip(n int) {
+	l.column += utf8.RuneCountInString(l.input[l.pos : l.pos+n])
+	l.pos += n
+}
+
+// LexError is returned for malformed input, such as an unterminated table.
+type LexError struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e LexError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Message)
+}
+
 func (l *lexer) ignore() {
 	l.start = l.pos
 }
@@ -163,10 +307,14 @@ func (l *lexer) backup() {
 	l.pos -= l.width
 	if l.pos < len(l.input) && l.input[l.pos] == '\n' {
 		l.line--
+		l.column = l.prevCol
+	} else if l.width > 0 {
+		l.column--
 	}
 }
 
 func (l *lexer) next() (rune rune) {
+	l.fill()
 	if l.pos >= len(l.input) {
 		l.width = 0
 		return eof
@@ -176,6 +324,10 @@ func (l *lexer) next() (rune rune) {
 
 	if rune == '\n' {
 		l.line++
+		l.prevCol = l.column
+		l.column = 1
+	} else {
+		l.column++
 	}
 
 	return rune
@@ -187,11 +339,176 @@ func (l *lexer) peek() rune {
 	return rune
 }
 
+// escape consumes a backslash followed by a markup character, keeping the
+// character as plain text.
+func (l *lexer) escape() bool {
+	if l.pos+1 >= len(l.input) || l.input[l.pos] != cmdStart || !strings.ContainsRune(escapable, rune(l.input[l.pos+1])) {
+		return false
+	}
+
+	if l.pos > l.start {
+		l.emit(ItemText)
+	}
+
+	l.next()
+	l.ignore()
+	l.next()
+
+	return true
+}
+
+// script emits the ^superscript^ or ~subscript~ span starting at pos, if
+// any. As in pandoc, the text between the delimiters is not empty and holds
+// no spaces, so a lone ^ or ~ stays plain text.
+func (l *lexer) script(typ ItemType, delim byte) bool {
+	s := l.input[l.pos:]
+	if len(s) < 3 || s[0] != delim {
+		return false
+	}
+
+	end := strings.IndexByte(s[1:], delim)
+	if end <= 0 || strings.ContainsAny(s[1:end+1], " \t\n") {
+		return false
+	}
+
+	if l.pos > l.start {
+		l.emit(ItemText)
+	}
+
+	l.skip(1)
+	l.ignore()
+	l.skip(end)
+	l.emit(typ)
+	l.skip(1)
+	l.ignore()
+
+	return true
+}
+
+// opensSpan reports whether the delimiter ending at from opens a span: it is
+// followed by a word and closed by delim later on the line. An == or a
+// single * left open stays plain text, as in a == b or 5 * 3.
+func (l *lexer) opensSpan(from int, delim string) bool {
+	rest := l.input[from:]
+	if rest == "" || strings.ContainsRune(" \t\n", rune(rest[0])) {
+		return false
+	}
+	if end := strings.IndexByte(rest, '\n'); end >= 0 {
+		rest = rest[:end]
+	}
+
+	return strings.Contains(rest, delim)
+}
+
+// lexInline starts lexing the inline markup at pos, the state reading it
+// returning to self. Otherwise it consumes the next rune as plain text and
+// returns it with a nil state, eof once the input is exhausted.
+func lexInline(l *lexer, self stateFn) (stateFn, rune) {
+	if strings.HasPrefix(l.input[l.pos:], emSymbol) {
+		if l.pos > l.start {
+			l.emit(ItemText)
+		}
+
+		l.next()
+		l.next()
+
+		return lexEm(self), 0
+	}
+
+	if strings.HasPrefix(l.input[l.pos:], strikeSymbol) {
+		if l.pos > l.start {
+			l.emit(ItemText)
+		}
+
+		l.next()
+		l.next()
+
+		return lexStrike(self), 0
+	}
+
+	if strings.HasPrefix(l.input[l.pos:], markSymbol) && l.opensSpan(l.pos+len(markSymbol), markSymbol) {
+		if l.pos > l.start {
+			l.emit(ItemText)
+		}
+
+		l.next()
+		l.next()
+
+		return lexMark(self), 0
+	}
+
+	if l.script(ItemSup, supRune) || l.script(ItemSub, subRune) {
+		return self, 0
+	}
+
+	if l.pos < len(l.input) && l.input[l.pos] == codeRune {
+		if l.pos > l.start {
+			l.emit(ItemText)
+		}
+
+		l.next()
+
+		return lexCode(self), 0
+	}
+
+	if l.escape() {
+		return self, 0
+	}
+
+	next := l.next()
+	if next == cmdStart {
+		if l.pos > l.start {
+			l.backup()
+			l.emit(ItemText)
+			l.next()
+		}
+
+		return lexCmdName(self), 0
+	}
+
+	if next == boldRune && (l.peek() == boldRune || l.opensSpan(l.pos, string(boldRune))) {
+		if l.pos > l.start {
+			l.backup()
+			l.emit(ItemText)
+			l.next()
+		}
+
+		if l.peek() == boldRune {
+			l.next()
+			return lexBold(self), 0
+		}
+
+		return lexItalic(self), 0
+	}
+
+	if next == '[' {
+		if l.pos > l.start {
+			l.backup()
+			l.emit(ItemText)
+			l.next()
+		}
+
+		return lexLinkHead(self), 0
+	}
+
+	return nil, next
+}
+
 func lexText(l *lexer) stateFn {
 	for {
+		if strings.HasPrefix(l.input[l.pos:], subSection) {
+			if l.pos > l.start {
+				l.emit(ItemText)
+			}
+
+			l.skip(len(subSection))
+			l.ignore()
+			return lexSubSection
+		}
+
 		if strings.HasPrefix(l.input[l.pos:], section) {
 			if l.pos > l.start {
-				l.emit(itemText)
+				l.emit(ItemText)
 			}
 
 			l.next()
@@ -202,7 +519,7 @@ func lexText(l *lexer) stateFn {
 
 		if strings.HasPrefix(l.input[l.pos:], table) {
 			if l.pos > l.start {
-				l.emit(itemText)
+				l.emit(ItemText)
 			}
 
 			return lexTableTitle(lexText)
@@ -210,17 +527,17 @@ func lexText(l *lexer) stateFn {
 
 		if strings.HasPrefix(l.input[l.pos:], annex) {
 			if l.pos > l.start {
-				l.emit(itemText)
+				l.emit(ItemText)
 			}
 
-			l.pos += 5
+			l.skip(5)
 			l.ignore()
 			return lexAnnex
 		}
 
 		if strings.HasPrefix(l.input[l.pos:], chapter) {
 			if l.pos > l.start {
-				l.emit(itemText)
+				l.emit(ItemText)
 			}
 
 			l.next()
@@ -228,25 +545,35 @@ func lexText(l *lexer) stateFn {
 			return lexChapter
 		}
 
-		if strings.HasPrefix(l.input[l.pos:], listElement) {
+		if (l.pos == 0 || l.input[l.pos-1] == '\n') && defTerm(l.input[l.pos:]) {
 			if l.pos > l.start {
-				l.emit(itemText)
+				l.emit(ItemText)
+			}
+
+			l.emitCustom(ItemDefListOpen, "")
+			l.emitCustom(ItemDefTerm, "")
+			return lexDefList
+		}
+
+		if indent, width, style, ok := listMarker(l.input[l.pos:]); ok && indent == 0 {
+			if l.pos > l.start {
+				l.emit(ItemText)
 			}
 			l.next()
-			l.next()
-			l.next()
+			l.skip(width)
 			l.ignore()
-			l.emitTrim(itemListOpen)
-			l.emit(itemStartListElement)
+			l.indents = append(l.indents, 0)
+			l.emitCustom(ItemListOpen, style)
+			l.emit(ItemStartListElement)
 			return lexListItem
 		}
 
 		if strings.HasPrefix(l.input[l.pos:], newLine) {
 			if l.pos > l.start {
-				l.emit(itemText)
+				l.emit(ItemText)
 			}
 
-			l.emitTrim(itemNewLine)
+			l.emitTrim(ItemNewLine)
 
 			l.next()
 			l.ignore()
@@ -254,46 +581,46 @@ func lexText(l *lexer) stateFn {
 			return lexText
 		}
 
-		if strings.HasPrefix(l.input[l.pos:], emSymbol) {
-			if l.pos > l.start {
-				l.emit(itemText)
+		if l.pos == 0 || l.input[l.pos-1] == '\n' {
+			line := l.input[l.pos:]
+			if end := strings.Index(line, newLine); end >= 0 {
+				line = line[:end]
 			}
 
-			l.next()
-			l.next()
+			if strings.TrimSpace(line) == rule {
+				if l.pos > l.start {
+					l.emit(ItemText)
+				}
 
-			return lexEm(lexText)
+				l.skip(len(line))
+				l.ignore()
+				l.emitTrim(ItemRule)
+				return lexText
+			}
 		}
 
-		next := l.next()
-		if next == cmdStart {
+		if strings.HasPrefix(l.input[l.pos:], quote) && (l.pos == 0 || l.input[l.pos-1] == '\n') {
 			if l.pos > l.start {
-				l.backup()
-				l.emit(itemText)
-				l.next()
+				l.emit(ItemText)
 			}
 
-			return lexCmdName(lexText)
+			l.skip(len(quote))
+			l.ignore()
+			l.emitTrim(ItemQuoteOpen)
+			return lexQuote
 		}
 
-		if next == boldRune {
+		if strings.HasPrefix(l.input[l.pos:], codeFence) && (l.pos == 0 || l.input[l.pos-1] == '\n') {
 			if l.pos > l.start {
-				l.backup()
-				l.emit(itemText)
-				l.next()
+				l.emit(ItemText)
 			}
 
-			return lexBold(lexText)
+			return lexCodeBlock(lexText)
 		}
 
-		if next == '[' {
-			if l.pos > l.start {
-				l.backup()
-				l.emit(itemText)
-				l.next()
-			}
-
-			return lexLinkHead(lexText)
+		state, next := lexInline(l, lexText)
+		if state != nil {
+			return state
 		}
 
 		if next == eof {
@@ -302,127 +629,294 @@ func lexText(l *lexer) stateFn {
 	}
 
 	if l.pos > l.start {
-		l.emitTrim(itemText)
+		l.emitTrim(ItemText)
 	}
 
-	l.emit(itemEOF)
+	l.emit(ItemEOF)
 	return nil
 }
 
 func lexChapter(l *lexer) stateFn {
 	for {
-		if strings.HasPrefix(l.input[l.pos:], newLine) {
-			l.emitTrim(itemChapter)
-			return lexText
-		}
-
-		if l.next() == eof {
-			l.backup()
+		if strings.HasPrefix(l.input[l.pos:], newLine) || l.pos >= len(l.input) {
+			l.emitTrim(ItemChapter)
 			return lexText
 		}
 
+		l.next()
 	}
 }
 
 func lexSection(l *lexer) stateFn {
 	for {
-		if strings.HasPrefix(l.input[l.pos:], newLine) {
-			l.emitTrim(itemSection)
+		if strings.HasPrefix(l.input[l.pos:], newLine) || l.pos >= len(l.input) {
+			l.emitTrim(ItemSection)
 			return lexText
 		}
 
-		if l.next() == eof {
-			l.backup()
+		l.next()
+	}
+}
+
+func lexSubSection(l *lexer) stateFn {
+	for {
+		if strings.HasPrefix(l.input[l.pos:], newLine) || l.pos >= len(l.input) {
+			l.emitTrim(ItemSubSection)
 			return lexText
 		}
 
+		l.next()
 	}
 }
 
 func lexAnnex(l *lexer) stateFn {
 	for {
-		if strings.HasPrefix(l.input[l.pos:], newLine) {
-			l.emitTrim(itemAnnex)
-			return lexText
-		}
-
-		if l.next() == eof {
-			l.backup()
+		if strings.HasPrefix(l.input[l.pos:], newLine) || l.pos >= len(l.input) {
+			l.emitTrim(ItemAnnex)
 			return lexText
 		}
 
+		l.next()
 	}
 }
 
 func lexListItem(l *lexer) stateFn {
 	for {
 
-		if strings.HasPrefix(l.input[l.pos:], listElement) {
+		if strings.HasPrefix(l.input[l.pos:], newLine) {
 			if l.pos > l.start {
-				l.emit(itemText)
+				l.emit(ItemText)
 			}
+
+			indent, width, style, ok := listMarker(l.input[l.pos:])
+			if !ok {
+				return lexListEnd
+			}
+
 			l.next()
-			l.next()
-			l.next()
+			l.skip(indent + width)
 			l.ignore()
-			l.emit(itemEndListElement)
-			l.emit(itemStartListElement)
-			return lexListItem
+
+			top := l.indents[len(l.indents)-1]
+			if indent > top {
+				l.indents = append(l.indents, indent)
+				l.emitCustom(ItemListOpen, style)
+				l.emit(ItemStartListElement)
+				return lexListItem
+			}
+
+			return lexListDedent(indent)
+		}
+
+		state, next := lexInline(l, lexListItem)
+		if state != nil {
+			return state
+		}
+
+		if next == eof {
+			l.backup()
+			return lexText
+		}
+
+	}
+}
+
+// listMarker reports whether s starts a list item on the next line, how
+// many spaces it is indented by, the length of its marker and the list style
+// the marker asks for: "" for "- " and "decimal" for "1. ".
+func listMarker(s string) (indent int, width int, style string, ok bool) {
+	if !strings.HasPrefix(s, newLine) {
+		return 0, 0, "", false
+	}
+
+	rest := strings.TrimLeft(s[1:], " ")
+	indent = len(s) - 1 - len(rest)
+
+	if strings.HasPrefix(rest, listElement[1:]) {
+		return indent, len(listElement) - 1, "", true
+	}
+
+	digits := len(rest) - len(strings.TrimLeft(rest, "0123456789"))
+	if digits > 0 && strings.HasPrefix(rest[digits:], ". ") {
+		return indent, digits + 2, "decimal", true
+	}
+
+	return 0, 0, "", false
+}
+
+// lexListDedent closes the nested lists deeper than indent, one per call so
+// the items channel never fills, then starts the next item.
+func lexListDedent(indent int) stateFn {
+	return func(l *lexer) stateFn {
+		if len(l.indents) > 1 && l.indents[len(l.indents)-1] > indent {
+			l.indents = l.indents[:len(l.indents)-1]
+			l.emitTrim(ItemEndListElement)
+			l.emitTrim(ItemListClose)
+			return lexListDedent(indent)
 		}
 
+		l.emitTrim(ItemEndListElement)
+		l.emitTrim(ItemStartListElement)
+		return lexListItem
+	}
+}
+
+// lexListEnd closes every open list level, one per call.
+func lexListEnd(l *lexer) stateFn {
+	l.indents = l.indents[:len(l.indents)-1]
+	l.emitTrim(ItemEndListElement)
+	l.emitTrim(ItemListClose)
+
+	if len(l.indents) > 0 {
+		return lexListEnd
+	}
+
+	return lexText
+}
+
+// defTerm reports whether s starts with a definition term: a non-empty line
+// followed by a ": " definition line.
+func defTerm(s string) bool {
+	end := strings.Index(s, newLine)
+	if end < 0 || strings.TrimSpace(s[:end]) == "" {
+		return false
+	}
+
+	return strings.HasPrefix(s[end+1:], definition)
+}
+
+// lexDefList reads the terms of a definition list and their ": " lines, up
+// to the first line that is neither.
+func lexDefList(l *lexer) stateFn {
+	for {
 		if strings.HasPrefix(l.input[l.pos:], newLine) {
 			if l.pos > l.start {
-				l.emit(itemText)
+				l.emit(ItemText)
 			}
-			l.emitTrim(itemEndListElement)
-			l.emitTrim(itemListClose)
+
+			rest := l.input[l.pos+1:]
+			if strings.HasPrefix(rest, definition) {
+				l.next()
+				l.skip(len(definition))
+				l.ignore()
+				l.emitCustom(ItemDefDesc, "")
+				return lexDefList
+			}
+
+			if defTerm(rest) {
+				l.next()
+				l.ignore()
+				l.emitCustom(ItemDefTerm, "")
+				return lexDefList
+			}
+
+			l.emitCustom(ItemDefListClose, "")
 			return lexText
 		}
 
-		if strings.HasPrefix(l.input[l.pos:], emSymbol) {
+		state, next := lexInline(l, lexDefList)
+		if state != nil {
+			return state
+		}
+
+		if next == eof {
 			if l.pos > l.start {
-				l.emit(itemText)
+				l.emitTrim(ItemText)
 			}
-
-			l.next()
-			l.next()
-
-			return lexEm(lexListItem)
+			l.emitCustom(ItemDefListClose, "")
+			return lexText
 		}
+	}
+}
 
-		next := l.next()
-		if next == boldRune {
+// lexQuote reads the lines of a blockquote. Consecutive quoted lines form a
+// paragraph, a line holding only ">" starts a new one.
+func lexQuote(l *lexer) stateFn {
+	for {
+		if strings.HasPrefix(l.input[l.pos:], newLine) {
 			if l.pos > l.start {
-				l.backup()
-				l.emit(itemText)
+				l.emit(ItemText)
+			}
+
+			rest := l.input[l.pos+1:]
+			if strings.HasPrefix(rest, quote) {
 				l.next()
+				l.skip(len(quote))
+				l.ignore()
+				l.emitCustom(ItemText, newLine)
+				return lexQuote
+			}
+
+			if rest == ">" || strings.HasPrefix(rest, ">\n") {
+				l.next()
+				l.skip(1)
+				if strings.HasPrefix(l.input[l.pos:], newLine+quote) {
+					l.next()
+					l.skip(len(quote))
+				}
+				l.ignore()
+				l.emitTrim(ItemNewLine)
+				return lexQuote
 			}
 
-			return lexBold(lexListItem)
+			l.emitTrim(ItemQuoteClose)
+			return lexText
+		}
+
+		state, next := lexInline(l, lexQuote)
+		if state != nil {
+			return state
 		}
 
 		if next == eof {
-			l.backup()
+			if l.pos > l.start {
+				l.emitTrim(ItemText)
+			}
+
+			l.emitTrim(ItemQuoteClose)
 			return lexText
 		}
-
 	}
 }
 
 func lexBold(fn stateFn) stateFn {
 	return func(l *lexer) stateFn {
 		l.ignore()
+		line, column := l.line, l.column-len(boldSymbol)
+		for {
+
+			if strings.HasPrefix(l.input[l.pos:], boldSymbol) {
+				l.emit(ItemBold)
+				l.next()
+				l.next()
+				l.ignore()
+				return fn
+			}
+
+			if l.next() == eof {
+				return l.errorf(line, column, "unterminated bold")
+			}
+		}
+	}
+}
+
+func lexItalic(fn stateFn) stateFn {
+	return func(l *lexer) stateFn {
+		l.ignore()
+		line, column := l.line, l.column-1
 		for {
 			next := l.next()
+			if next == eof {
+				return l.errorf(line, column, "unterminated italic")
+			}
 
 			if next == boldRune {
 				l.backup()
-				l.emit(itemBold)
+				l.emit(ItemItalic)
 				l.next()
 				l.ignore()
 				return fn
 			}
-
 		}
 	}
 }
@@ -430,51 +924,254 @@ func lexBold(fn stateFn) stateFn {
 func lexEm(fn stateFn) stateFn {
 	return func(l *lexer) stateFn {
 		l.ignore()
+		line, column := l.line, l.column-len(emSymbol)
 		for {
 
 			if strings.HasPrefix(l.input[l.pos:], emSymbol) {
-				l.emit(itemEm)
+				l.emit(ItemEm)
 				l.next()
 				l.next()
 				l.ignore()
 				return fn
 			}
 
-			l.next()
+			if l.next() == eof {
+				return l.errorf(line, column, "unterminated emphasis")
+			}
+		}
+	}
+}
+
+func lexMark(fn stateFn) stateFn {
+	return func(l *lexer) stateFn {
+		l.ignore()
+		line, column := l.line, l.column-len(markSymbol)
+		for {
+
+			if strings.HasPrefix(l.input[l.pos:], markSymbol) {
+				l.emit(ItemMark)
+				l.next()
+				l.next()
+				l.ignore()
+				return fn
+			}
+
+			if l.next() == eof {
+				return l.errorf(line, column, "unterminated highlight")
+			}
+		}
+	}
+}
+
+func lexStrike(fn stateFn) stateFn {
+	return func(l *lexer) stateFn {
+		l.ignore()
+		line, column := l.line, l.column-len(strikeSymbol)
+		for {
+
+			if strings.HasPrefix(l.input[l.pos:], strikeSymbol) {
+				l.emit(ItemStrike)
+				l.next()
+				l.next()
+				l.ignore()
+				return fn
+			}
+
+			if l.next() == eof {
+				return l.errorf(line, column, "unterminated strikethrough")
+			}
+		}
+	}
+}
+
+// lexCode reads a code span verbatim, markup inside it is not interpreted.
+func lexCode(fn stateFn) stateFn {
+	return func(l *lexer) stateFn {
+		l.ignore()
+		line, column := l.line, l.column-1
+		for {
+			next := l.next()
+			if next == eof {
+				return l.errorf(line, column, "unterminated code span")
+			}
+
+			if next == codeRune {
+				l.backup()
+				l.emit(ItemCode)
+				l.next()
+				l.ignore()
+				return fn
+			}
+		}
+	}
+}
+
+// lexCodeBlock reads a fenced block verbatim up to the closing fence, the
+// rest of the opening fence line is ignored.
+func lexCodeBlock(fn stateFn) stateFn {
+	return func(l *lexer) stateFn {
+		line, column := l.line, l.column
+		end := strings.Index(l.input[l.pos:], newLine)
+		if end < 0 {
+			return l.errorf(line, column, "unterminated code block")
+		}
+		l.skip(end)
+		l.next()
+		l.ignore()
+
+		for {
+			if strings.HasPrefix(l.input[l.pos:], codeFence) && l.input[l.pos-1] == '\n' {
+				l.emitCustom(ItemCodeBlock, strings.TrimSuffix(l.input[l.start:l.pos], newLine))
+				l.skip(len(codeFence))
+				l.ignore()
+				return fn
+			}
+
+			if l.next() == eof {
+				return l.errorf(line, column, "unterminated code block")
+			}
 		}
 	}
 }
 
 func lexTableTitle(fn stateFn) stateFn {
 	return func(l *lexer) stateFn {
-		l.pos += len(table)
+		l.skip(len(table))
 		l.ignore()
+		line, column := l.line, l.column-len(table)
 
 		for {
+			// a title-only table closes on its own line: -table- Title -table-
+			if strings.HasPrefix(l.input[l.pos:], table) {
+				l.emitTrim(ItemTableStart)
+				l.emit(ItemTableEnd)
+				l.skip(len(table))
+				l.ignore()
+				return fn
+			}
+
 			next := l.next()
+			if next == eof {
+				return l.errorf(line, column, "unterminated table")
+			}
+
 			if next == rune(newLine[0]) {
-				l.emitTrim(itemTableStart)
-				return lexTable(fn)
+				l.emitTrim(ItemTableStart)
+				if row := l.input[l.pos:]; strings.Contains(row, newLine) {
+					row = row[:strings.Index(row, newLine)]
+					if aligns, ok := tableAligns(row); ok {
+						l.skip(len(row))
+						l.next()
+						l.ignore()
+						l.emitCustom(ItemTableAlign, aligns)
+					}
+				}
+				return lexTable(fn, line, column)
+			}
+		}
+	}
+}
+
+// splitCells splits a table row on the | not escaped as \|, leaving the
+// escapes for the inline lexing of the cells.
+func splitCells(row string) []string {
+	cells := []string{}
+	start := 0
+	for i := 0; i < len(row); i++ {
+		switch row[i] {
+		case cmdStart:
+			i++
+		case '|':
+			cells = append(cells, row[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(cells, row[start:])
+}
+
+// cellItems lexes the inline markup of a table cell.
+func cellItems(cell string) ([]Item, error) {
+	l := lexString(cell)
+	l.state = lexCell
+
+	items := []Item{}
+	for it := l.nextItem(); it.typ != ItemEOF && it.typ != ItemError; it = l.nextItem() {
+		items = append(items, it)
+	}
+
+	return items, l.err
+}
+
+// lexCell reads the inline markup of a table cell: emphasis, code, links and
+// commands.
+func lexCell(l *lexer) stateFn {
+	for {
+		state, next := lexInline(l, lexCell)
+		if state != nil {
+			return state
+		}
+
+		if next == eof {
+			if l.pos > l.start {
+				l.emit(ItemText)
 			}
+			l.emit(ItemEOF)
+			return nil
+		}
+	}
+}
+
+// tableAligns reads a row of :--, :-: and --: markers into the alignment of
+// each column, left, center, right or empty, joined by |.
+func tableAligns(row string) (string, bool) {
+	aligns := []string{}
+	for _, cell := range strings.Split(row, "|") {
+		cell = strings.TrimSpace(cell)
+		dashes := strings.Trim(cell, ":")
+		if dashes == "" || strings.Trim(dashes, "-") != "" || len(cell)-len(dashes) > 2 {
+			return "", false
+		}
+
+		left, right := strings.HasPrefix(cell, ":"), strings.HasSuffix(cell, ":")
+		switch {
+		case left && right:
+			aligns = append(aligns, "center")
+		case left:
+			aligns = append(aligns, "left")
+		case right:
+			aligns = append(aligns, "right")
+		default:
+			aligns = append(aligns, "")
 		}
 	}
+
+	return strings.Join(aligns, "|"), true
 }
 
-func lexTable(fn stateFn) stateFn {
+func lexTable(fn stateFn, line, column int) stateFn {
 	return func(l *lexer) stateFn {
 		for {
 
 			if strings.HasPrefix(l.input[l.pos:], table) {
-				l.emit(itemTableEnd)
-				l.pos += len(table)
+				l.emit(ItemTableEnd)
+				l.skip(len(table))
 				l.ignore()
 				return fn
 			}
 
 			next := l.next()
+			if next == eof {
+				return l.errorf(line, column, "unterminated table")
+			}
+
 			if next == rune(newLine[0]) {
-				l.emitTrim(itemTableRow)
-				return lexTable(fn)
+				// emit the row before its newline so it keeps its own line
+				l.backup()
+				l.emitTrim(ItemTableRow)
+				l.next()
+				l.ignore()
+				return lexTable(fn, line, column)
 			}
 
 		}
@@ -484,9 +1181,14 @@ func lexTable(fn stateFn) stateFn {
 func lexCmdName(fn stateFn) stateFn {
 	return func(l *lexer) stateFn {
 		l.ignore()
+		line, column := l.line, l.column-1
 		for {
 
 			next := l.next()
+			if next == eof || next == '\n' {
+				return l.errorf(line, column, "unterminated command")
+			}
+
 			if next == '(' {
 				cmd := l.input[l.start : l.pos-1]
 				l.ignore()
@@ -497,13 +1199,45 @@ func lexCmdName(fn stateFn) stateFn {
 	}
 }
 
+// lexCmdArgs reads up to the closing paren, skipping balanced parens and the
+// ones inside double quotes or escaped with a backslash: parseArgs splits the
+// arguments later.
 func lexCmdArgs(cmd string, fn stateFn) stateFn {
 	return func(l *lexer) stateFn {
+		inQuote := false
+		depth := 0
+		line, column := l.line, l.column-1
 		for {
 			next := l.next()
+			if next == eof {
+				return l.errorf(line, column, "unterminated command")
+			}
+
+			if next == '\\' {
+				l.next()
+				continue
+			}
+
+			if next == '"' {
+				inQuote = !inQuote
+			}
+
+			if inQuote {
+				continue
+			}
+
+			if next == '(' {
+				depth++
+			}
+
+			if next == ')' && depth > 0 {
+				depth--
+				continue
+			}
+
 			if next == ')' {
 				l.backup()
-				l.emitCustom(itemCommand, fmt.Sprintf("%s|%s", cmd, l.input[l.start:l.pos]))
+				l.emitCustom(ItemCommand, fmt.Sprintf("%s|%s", cmd, l.input[l.start:l.pos]))
 				l.next()
 				l.ignore()
 				return fn
@@ -516,9 +1250,14 @@ func lexCmdArgs(cmd string, fn stateFn) stateFn {
 func lexLinkHead(fn stateFn) stateFn {
 	return func(l *lexer) stateFn {
 		l.ignore()
+		line, column := l.line, l.column-len(link)
 		for {
 
 			next := l.next()
+			if next == eof {
+				return l.errorf(line, column, "unterminated link")
+			}
+
 			if next == ']' {
 				text := l.input[l.start : l.pos-1]
 				l.next()
@@ -530,15 +1269,52 @@ func lexLinkHead(fn stateFn) stateFn {
 	}
 }
 
+var linkParens = strings.NewReplacer("\\(", "(", "\\)", ")")
+
+// lexLinkTail reads the link target up to the closing paren, balanced parens
+// such as in https://en.wikipedia.org/wiki/Go_(language) included. A lone
+// paren is written \( or \).
 func lexLinkTail(text string, fn stateFn) stateFn {
 	return func(l *lexer) stateFn {
+		depth := 0
+		line, column := l.line, l.column-1
 		for {
 			next := l.next()
+			if next == eof {
+				return l.errorf(line, column, "unterminated link")
+			}
+
+			if next == '\\' && (l.peek() == '(' || l.peek() == ')') {
+				l.next()
+				continue
+			}
+
+			if next == '(' {
+				depth++
+			}
+
+			if next == ')' && depth > 0 {
+				depth--
+				continue
+			}
+
 			if next == ')' {
 				l.backup()
-				l.emitCustom(itemLink, fmt.Sprintf("%s|%s", text, l.input[l.start:l.pos]))
+				link := linkParens.Replace(l.input[l.start:l.pos])
 				l.next()
 				l.ignore()
+
+				// an optional {flag,flag} hint follows the closing paren
+				if strings.HasPrefix(l.input[l.pos:], "{") {
+					end := strings.IndexAny(l.input[l.pos:], "}\n")
+					if end != -1 && l.input[l.pos+end] == '}' {
+						l.skip(end + 1)
+						link += l.input[l.start:l.pos]
+						l.ignore()
+					}
+				}
+
+				l.emitCustom(ItemLink, fmt.Sprintf("%s|%s", text, link))
 				return fn
 			}
 
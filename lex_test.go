@@ -0,0 +1,580 @@
+package rulebook
+
+import (
+	"io"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func lexItems(t *testing.T, input string) []Item {
+	t.Helper()
+
+	l := lex(strings.NewReader(input))
+	items := []Item{}
+	for it := l.nextItem(); it.typ != ItemEOF; it = l.nextItem() {
+		if it.typ == ItemError {
+			t.Fatalf("lex %q: %s", input, it.val)
+		}
+		items = append(items, it)
+	}
+
+	return items
+}
+
+// inlineItems keeps the items of the inline markup, dropping the text around
+// it and the structure of the block holding it.
+func inlineItems(items []Item) []Item {
+	inline := []Item{}
+	for _, it := range items {
+		switch it.typ {
+		case ItemBold, ItemItalic, ItemEm, ItemStrike, ItemMark, ItemSup, ItemSub, ItemCode, ItemCommand, ItemLink:
+			inline = append(inline, Item{typ: it.typ, val: it.val})
+		}
+	}
+
+	return inline
+}
+
+const inlineMarkup = "**b** *i* __e__ ~~s~~ ==m== ^p^ ~q~ `c` \\* \\cmd(x) [l](t)"
+
+func TestInlineMarkupInEveryBlock(t *testing.T) {
+	want := []Item{
+		{typ: ItemBold, val: "b"},
+		{typ: ItemItalic, val: "i"},
+		{typ: ItemEm, val: "e"},
+		{typ: ItemStrike, val: "s"},
+		{typ: ItemMark, val: "m"},
+		{typ: ItemSup, val: "p"},
+		{typ: ItemSub, val: "q"},
+		{typ: ItemCode, val: "c"},
+		{typ: ItemCommand, val: "cmd|x"},
+		{typ: ItemLink, val: "l|t"},
+	}
+
+	blocks := map[string]string{
+		"text":       inlineMarkup + "\n",
+		"list":       "- " + inlineMarkup + "\n",
+		"definition": "term\n: " + inlineMarkup + "\n",
+		"quote":      "> " + inlineMarkup + "\n",
+	}
+
+	for name, input := range blocks {
+		if got := inlineItems(lexItems(t, input)); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s:\ngot  %v\nwant %v", name, got, want)
+		}
+	}
+
+	cell, err := cellItems(inlineMarkup)
+	if err != nil {
+		t.Fatalf("cell: %v", err)
+	}
+	if got := inlineItems(cell); !reflect.DeepEqual(got, want) {
+		t.Errorf("cell:\ngot  %v\nwant %v", got, want)
+	}
+}
+
+func TestInlineMarkupAtEndOfInput(t *testing.T) {
+	for _, input := range []string{"a **b**", "- a **b**", "term\n: a **b**", "> a **b**"} {
+		items := lexItems(t, input)
+		if got := inlineItems(items); len(got) != 1 || got[0].typ != ItemBold {
+			t.Errorf("%q: expected a bold item, got %v", input, items)
+		}
+	}
+}
+
+func collectItems(l *lexer) []Item {
+	items := []Item{}
+	for {
+		it := l.nextItem()
+		items = append(items, it)
+		if it.typ == ItemEOF || it.typ == ItemError {
+			return items
+		}
+	}
+}
+
+// lexError returns the error ending the items of input, failing when the
+// input lexes without one.
+func lexError(t *testing.T, input string) string {
+	t.Helper()
+
+	items := collectItems(lex(strings.NewReader(input)))
+	if last := items[len(items)-1]; last.typ == ItemError {
+		return last.val
+	}
+	t.Fatalf("lex %q: expected an error", input)
+
+	return ""
+}
+
+// straddling are constructs the streaming lexer must read the same when the
+// lookahead boundary falls inside them.
+var straddling = []string{
+	"**bold text**",
+	"*italic*",
+	"__em__ ~~strike~~ ==mark==",
+	"^sup^ ~sub~",
+	"[a link](some-target)",
+	"\\cmd(a, \"b, c\", (d))",
+	"`code span`",
+	"\\* escaped",
+	"ééé àà",
+	"\n## Section Title\n",
+	"\n### Sub Section\n",
+	"\nANNEX Extra\n",
+	"\n-table- Title\na|b\n:-|-:\nc|d\n-table-\n",
+	"\n```\ncode\nblock\n```\n",
+	"\n> quoted\n>\n> more\n",
+	"\nterm\n: definition\n",
+	"\n- a\n  - b\n1. c\n",
+	"\n---\n",
+	"**b**> not a quote",
+	"**b**---\n",
+	"`c````not a fence",
+	"**" + strings.Repeat("long ", lookahead/4) + "bold**",
+	"\\cmd(" + strings.Repeat("arg, ", lookahead/4) + "last)",
+}
+
+func TestStreamingLexerAcrossLookahead(t *testing.T) {
+	for _, construct := range straddling {
+		positions := []int{2*lookahead - len(construct)/2}
+		for at := lookahead - len(construct) - 2; at <= lookahead+2; at++ {
+			if at > 20 && (len(construct) < 100 || at%97 == 0) {
+				positions = append(positions, at)
+			}
+		}
+
+		for _, at := range positions {
+			padding := strings.Repeat("word ", at/5) + strings.Repeat("x", at%5)
+			input := "# Chapter\n\n" + padding[len("# Chapter\n\n"):] + construct + " tail\n"
+
+			want := collectItems(lexString(input))
+			for name, reader := range map[string]io.Reader{
+				"reader":   strings.NewReader(input),
+				"one byte": iotest.OneByteReader(strings.NewReader(input)),
+				"half":     iotest.HalfReader(strings.NewReader(input)),
+			} {
+				if got := collectItems(lex(reader)); !reflect.DeepEqual(got, want) {
+					t.Errorf("%.40q at %d, %s reader:\ngot  %v\nwant %v", construct, at, name, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestStreamingLexerErrorsAcrossLookahead(t *testing.T) {
+	input := strings.Repeat("word ", lookahead/5) + "**never closed"
+
+	want := collectItems(lexString(input))
+	got := collectItems(lex(strings.NewReader(input)))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got  %v\nwant %v", got[len(got)-1], want[len(want)-1])
+	}
+	if last := got[len(got)-1]; last.typ != ItemError {
+		t.Errorf("expected an error, got %v", last)
+	}
+}
+
+func TestStreamingLexerMatchesWholeInput(t *testing.T) {
+	input := syntheticRulebook(20)
+	if len(input) < 4*lookahead {
+		t.Fatalf("synthetic rulebook too small: %d bytes", len(input))
+	}
+
+	want := collectItems(lexString(input))
+	if got := collectItems(lex(strings.NewReader(input))); !reflect.DeepEqual(got, want) {
+		t.Errorf("streamed items differ from the whole input ones")
+	}
+}
+
+func BenchmarkLex(b *testing.B) {
+	input := syntheticRulebook(50)
+
+	b.Run("stream", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			collectItems(lex(strings.NewReader(input)))
+		}
+	})
+
+	b.Run("whole", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			collectItems(lexString(input))
+		}
+	})
+}
+
+func TestEscapedMarkup(t *testing.T) {
+	tests := []struct {
+		input string
+		text  string
+	}{
+		{input: "price: 5\\* bonus\n", text: "price: 5* bonus"},
+		{input: "\\*\\*not bold\\*\\*\n", text: "**not bold**"},
+		{input: "\\[not a link](x)\n", text: "[not a link](x)"},
+		{input: "\\_\\_not em\\_\\_\n", text: "__not em__"},
+		{input: "back\\\\slash\n", text: "back\\slash"},
+	}
+
+	for _, test := range tests {
+		text := ""
+		for _, it := range lexItems(t, test.input) {
+			switch it.typ {
+			case ItemText:
+				text += it.val
+			case ItemBold, ItemItalic, ItemEm, ItemLink, ItemCommand:
+				t.Errorf("%q: unexpected %v item %q", test.input, it.typ, it.val)
+			}
+		}
+		if text != test.text {
+			t.Errorf("%q: text = %q, want %q", test.input, text, test.text)
+		}
+	}
+
+	out := build(t, "# Rules\n\nprice: 5\\* bonus\n\n- 5\\* \\[x](y)\n", BuilderConfig{})
+	assertContains(t, out, "price: 5* bonus", "<li>\n<p>\n5* [x](y)\n</p>")
+	assertNotContains(t, out, "<strong>", "<i>")
+}
+
+func TestCodeSpans(t *testing.T) {
+	for _, input := range []string{"Use `**x** \\cmd() __e__` here.\n", "- Use `**x** \\cmd() __e__` here.\n"} {
+		want := []Item{{typ: ItemCode, val: "**x** \\cmd() __e__"}}
+		if got := inlineItems(lexItems(t, input)); !reflect.DeepEqual(got, want) {
+			t.Errorf("%q:\ngot  %v\nwant %v", input, got, want)
+		}
+	}
+
+	if s := ItemCode.String(); s != "Code" {
+		t.Errorf("ItemCode.String() = %q", s)
+	}
+
+	out := build(t, "# Rules\n\nUse `a < b` and `**x**` here.\n\n- cast `fireball`\n", BuilderConfig{})
+	assertContains(t, out,
+		"<p class='indent'>\nUse <code>a &lt; b</code> and <code>**x**</code> here.\n</p>",
+		"<li>\n<p>\ncast <code>fireball</code>\n</p>",
+	)
+}
+
+func TestCodeBlocks(t *testing.T) {
+	items := lexItems(t, "Before\n```\nfn <x> **y** \\cmd()\n\n  indented\n```\nAfter\n")
+	blocks := []Item{}
+	for _, it := range items {
+		switch it.typ {
+		case ItemCodeBlock:
+			blocks = append(blocks, Item{typ: it.typ, val: it.val})
+		case ItemBold, ItemCommand:
+			t.Errorf("unexpected %v item %q in a code block", it.typ, it.val)
+		}
+	}
+	if want := []Item{{typ: ItemCodeBlock, val: "fn <x> **y** \\cmd()\n\n  indented"}}; !reflect.DeepEqual(blocks, want) {
+		t.Errorf("got  %v\nwant %v", blocks, want)
+	}
+
+	out := build(t, "# Rules\n\nBefore\n```\na < b\n```\nAfter\n", BuilderConfig{})
+	assertContains(t, out, "Before\n</p>\n<pre><code>a &lt; b</code></pre>\n<p>\nAfter\n</p>")
+
+	if err := lexError(t, "text\n\n```\nnever closed\n"); err != "line 3, column 1: unterminated code block" {
+		t.Errorf("unexpected error %q", err)
+	}
+	err := buildError(t, "# Rules\n\n```\nnever closed\n", BuilderConfig{})
+	assertContains(t, err, "line 3, column 1: unterminated code block")
+}
+
+func TestItalicAndBold(t *testing.T) {
+	want := []Item{{typ: ItemItalic, val: "a"}, {typ: ItemBold, val: "b"}, {typ: ItemItalic, val: "c"}}
+	for _, input := range []string{"*a* **b** *c*\n", "- *a* **b** *c*\n"} {
+		if got := inlineItems(lexItems(t, input)); !reflect.DeepEqual(got, want) {
+			t.Errorf("%q:\ngot  %v\nwant %v", input, got, want)
+		}
+	}
+
+	out := build(t, "# Rules\n\n*a* **b** *c*\n", BuilderConfig{})
+	assertContains(t, out, "<i>a</i> <strong>b</strong> <i>c</i>")
+}
+
+func TestStrikethrough(t *testing.T) {
+	if s := ItemStrike.String(); s != "Strike" {
+		t.Errorf("ItemStrike.String() = %q", s)
+	}
+
+	out := build(t, "# Rules\n\nWas ~~d6 <old>~~ now d8.\n\n- ~~gone~~\n", BuilderConfig{})
+	golden := "<h2><a id='rules'></a>I - Rules</h2>\n" +
+		"<p class='indent'>\nWas <del>d6 &lt;old&gt;</del> now d8.\n</p>\n" +
+		"<ol class='roman'>\n\n<li>\n<p>\n<del>gone</del>\n</p>\n\n</li>\n</ol>\n\n"
+	if out != golden {
+		t.Errorf("got:\n%s\nwant:\n%s", out, golden)
+	}
+
+	if err := lexError(t, "text\nWas ~~d6\n"); err != "line 2, column 5: unterminated strikethrough" {
+		t.Errorf("unexpected error %q", err)
+	}
+}
+
+func TestListMarker(t *testing.T) {
+	tests := []struct {
+		s      string
+		indent int
+		width  int
+		style  string
+		ok     bool
+	}{
+		{s: "\n- item", width: 2, ok: true},
+		{s: "\n  - item", indent: 2, width: 2, ok: true},
+		{s: "\n1. item", width: 3, style: "decimal", ok: true},
+		{s: "\n12. item", width: 4, style: "decimal", ok: true},
+		{s: "\n    3. item", indent: 4, width: 3, style: "decimal", ok: true},
+		{s: "\n1.5 damage"},
+		{s: "\n-table- T"},
+		{s: "- item"},
+	}
+
+	for _, test := range tests {
+		indent, width, style, ok := listMarker(test.s)
+		if indent != test.indent || width != test.width || style != test.style || ok != test.ok {
+			t.Errorf("listMarker(%q) = %d, %d, %q, %v", test.s, indent, width, style, ok)
+		}
+	}
+}
+
+func TestListStyles(t *testing.T) {
+	styles := []string{}
+	for _, it := range lexItems(t, "text\n- a\n\nb\n1. one\n2. two\n") {
+		if it.typ == ItemListOpen {
+			styles = append(styles, it.val)
+		}
+	}
+	if want := []string{"", "decimal"}; !reflect.DeepEqual(styles, want) {
+		t.Errorf("list styles = %q, want %q", styles, want)
+	}
+
+	out := build(t, "# Rules\n\n- a\n\n1. one\n2. two\n", BuilderConfig{})
+	assertContains(t, out, "<ol class='roman'>\n\n<li>\n<p>\na", "<ol class='decimal'>\n\n<li>\n<p>\none")
+}
+
+func TestBalancedParens(t *testing.T) {
+	want := []Item{
+		{typ: ItemCommand, val: "color|f(g(x)), ff0000"},
+		{typ: ItemLink, val: "map|https://example.com/map_(north)"},
+	}
+	if got := inlineItems(lexItems(t, "A \\color(f(g(x)), ff0000) and [map](https://example.com/map_(north)).\n")); !reflect.DeepEqual(got, want) {
+		t.Errorf("got  %v\nwant %v", got, want)
+	}
+
+	out := build(t, "# Rules\n\nA \\color(f(x), ff0000) and [map](https://example.com/map_(north)).\n", BuilderConfig{})
+	assertContains(t, out, "A <span style='color: #ff0000'>f(x)</span> and <a href='https://example.com/map_(north)'>map</a>.")
+
+	if err := lexError(t, "A \\color(f(x, ff0000)\n"); !strings.HasSuffix(err, "unterminated command") {
+		t.Errorf("unexpected error %q", err)
+	}
+}
+
+func TestLinkTailWithParens(t *testing.T) {
+	out := build(t, "# Rules\n\nSee [Go](https://en.wikipedia.org/wiki/Go_(language)), [w](https://x.org/a_(b)_(c)?d=(e)){blank} and [esc](https://x.org/a\\)b).\n", BuilderConfig{})
+	assertContains(t, out,
+		"<a href='https://en.wikipedia.org/wiki/Go_(language)'>Go</a>, ",
+		"<a href='https://x.org/a_(b)_(c)?d=(e)' target='_blank' rel='noopener'>w</a>",
+		"<a href='https://x.org/a)b'>esc</a>.",
+	)
+}
+
+// lexUnterminated lexes inputs made of random text around an unterminated
+// construct and checks each one ends with the error, rather than a hang.
+func lexUnterminated(t *testing.T, construct string, message string) {
+	t.Helper()
+
+	fragments := []string{"text ", "word", " ", "\n", "\n\n", "- item ", "# Title\n", "**b** ", "__e__ ", "`c` ", "\\cmd(x) ", "[l](t) "}
+	random := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 200; i++ {
+		prefix := ""
+		for n := random.Intn(6); n > 0; n-- {
+			prefix += fragments[random.Intn(len(fragments))]
+		}
+		input := prefix + construct + strings.Repeat("tail ", random.Intn(3))
+
+		done := make(chan []Item, 1)
+		go func() { done <- collectItems(lex(strings.NewReader(input))) }()
+
+		select {
+		case items := <-done:
+			last := items[len(items)-1]
+			if last.typ != ItemError || !strings.HasSuffix(last.val, message) {
+				t.Errorf("%q: expected %q, got %v", input, message, last)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%q: the lexer does not terminate", input)
+		}
+	}
+}
+
+func TestUnterminatedBold(t *testing.T) {
+	if err := lexError(t, "text **oops"); err != "line 1, column 6: unterminated bold" {
+		t.Errorf("unexpected error %q", err)
+	}
+	lexUnterminated(t, "**oops ", "unterminated bold")
+
+	err := buildError(t, "# Rules\n\ntext **oops\n", BuilderConfig{})
+	assertContains(t, err, "line 3, column 6: unterminated bold")
+}
+
+func TestUnterminatedEmphasis(t *testing.T) {
+	if err := lexError(t, "text\n__italic"); err != "line 2, column 1: unterminated emphasis" {
+		t.Errorf("unexpected error %q", err)
+	}
+	lexUnterminated(t, "__oops ", "unterminated emphasis")
+
+	err := buildError(t, "# Rules\n\ntext __oops", BuilderConfig{})
+	assertContains(t, err, "line 3, column 6: unterminated emphasis")
+}
+
+func TestUnterminatedCommand(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{input: "text \\img", err: "line 1, column 6: unterminated command"},
+		{input: "text \\img orc.png\nmore", err: "line 1, column 6: unterminated command"},
+		{input: "text \\img(orc.png, Orc", err: "line 1, column 10: unterminated command"},
+		{input: "\\img(orc.png,\nOrc", err: "line 1, column 5: unterminated command"},
+	}
+
+	for _, test := range tests {
+		if err := lexError(t, test.input); err != test.err {
+			t.Errorf("%q: error %q, want %q", test.input, err, test.err)
+		}
+	}
+	lexUnterminated(t, "\\img(foo ", "unterminated command")
+	lexUnterminated(t, "\\img", "unterminated command")
+}
+
+func TestUnterminatedTable(t *testing.T) {
+	for _, input := range []string{"text\n-table- Weapons\nName|Damage\nSword|d8\n", "text\n-table- Weapons", "text\n-table-"} {
+		if err := lexError(t, input); err != "line 2, column 1: unterminated table" {
+			t.Errorf("%q: unexpected error %q", input, err)
+		}
+	}
+	lexUnterminated(t, "\n-table- T\na|b\n", "unterminated table")
+
+	err := buildError(t, "# Rules\n\n-table- Weapons\nName|Damage\n", BuilderConfig{})
+	assertContains(t, err, "line 3, column 1: unterminated table")
+}
+
+func TestHeadingAtEndOfInput(t *testing.T) {
+	tests := []struct {
+		input string
+		typ   ItemType
+		title string
+	}{
+		{input: "text\n# The End", typ: ItemChapter, title: "The End"},
+		{input: "text\n## The End", typ: ItemSection, title: "The End"},
+		{input: "text\n### The End", typ: ItemSubSection, title: "The End"},
+		{input: "text\nANNEX The End", typ: ItemAnnex, title: "The End"},
+		{input: "text\n# The End  ", typ: ItemChapter, title: "The End"},
+	}
+
+	for _, test := range tests {
+		items := lexItems(t, test.input)
+		if last := items[len(items)-1]; last.typ != test.typ || last.val != test.title {
+			t.Errorf("%q: last item %v, want %v %q", test.input, last, test.typ, test.title)
+		}
+	}
+
+	out := build(t, "# Rules\n\nText.\n\n## The End", BuilderConfig{})
+	assertContains(t, out, "<h3><a name='the-end'></a>The End</h3>")
+}
+
+func TestLexErrorColumn(t *testing.T) {
+	tests := []struct {
+		input  string
+		line   int
+		column int
+	}{
+		{input: "**oops", line: 1, column: 1},
+		{input: "first line\nsome **oops", line: 2, column: 6},
+		{input: "a\nb\n  [link](", line: 3, column: 9},
+		{input: "é **oops", line: 1, column: 3},
+		{input: "- item\n- more \\img(x", line: 2, column: 12},
+	}
+
+	for _, test := range tests {
+		_, err := Parse(strings.NewReader(test.input))
+		lexErr, ok := err.(LexError)
+		if !ok {
+			t.Fatalf("%q: expected a LexError, got %T %v", test.input, err, err)
+		}
+		if lexErr.Line != test.line || lexErr.Column != test.column {
+			t.Errorf("%q: error at %d:%d, want %d:%d", test.input, lexErr.Line, lexErr.Column, test.line, test.column)
+		}
+	}
+}
+
+func TestSupSub(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []Item
+	}{
+		{input: "X^2^ and H~2~O\n", want: []Item{{typ: ItemSup, val: "2"}, {typ: ItemSub, val: "2"}}},
+		{input: "~~gone~~ H~2~O\n", want: []Item{{typ: ItemStrike, val: "gone"}, {typ: ItemSub, val: "2"}}},
+		{input: "- 1d6^+1^ and CO~2~\n", want: []Item{{typ: ItemSup, val: "+1"}, {typ: ItemSub, val: "2"}}},
+	}
+
+	for _, test := range tests {
+		if got := inlineItems(lexItems(t, test.input)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q:\ngot  %v\nwant %v", test.input, got, test.want)
+		}
+	}
+
+	out := build(t, "# Rules\n\nX^2^ and H~2~O, not ~~this~~.\n", BuilderConfig{})
+	assertContains(t, out, "X<sup>2</sup> and H<sub>2</sub>O, not <del>this</del>.")
+}
+
+func TestTableAligns(t *testing.T) {
+	tests := []struct {
+		row    string
+		aligns string
+		ok     bool
+	}{
+		{row: ":-- | :-: | --: | ---", aligns: "left|center|right|", ok: true},
+		{row: ":-:", aligns: "center", ok: true},
+		{row: "Name|Damage"},
+		{row: "::"},
+		{row: ":--:-"},
+	}
+
+	for _, test := range tests {
+		aligns, ok := tableAligns(test.row)
+		if ok != test.ok || aligns != test.aligns {
+			t.Errorf("tableAligns(%q) = %q, %v, want %q, %v", test.row, aligns, ok, test.aligns, test.ok)
+		}
+	}
+
+	out := build(t, "# Rules\n\n-table- Weapons\n:-- | :-: | --: | ---\nName|Damage|Cost|Note\nSword|d8|15|-\n-table-\n", BuilderConfig{})
+	assertContains(t, out, "<th colspan='4'>Weapons</th>",
+		"<td class='head' style='text-align: left'>Name</td>\n<td class='head' style='text-align: center'>Damage</td>\n"+
+			"<td class='head' style='text-align: right'>Cost</td>\n<td class='head'>Note</td>",
+		"<td class='head' style='text-align: left'>Sword</td>\n<td class='lead' style='text-align: center'>d8</td>\n"+
+			"<td class='lead' style='text-align: right'>15</td>\n<td class='lead'>-</td>")
+}
+
+func TestLoneAsteriskIsText(t *testing.T) {
+	out := build(t, "# Rules\n\n5 * 3 = 15, and *this* is italic.\n\n- 2 * 4 * 3\n", BuilderConfig{})
+	assertContains(t, out, "5 * 3 = 15, and <i>this</i> is italic.", "2 * 4 * 3")
+
+	if got := inlineItems(lexItems(t, "5 * 3\n*a*\n")); !reflect.DeepEqual(got, []Item{{typ: ItemItalic, val: "a"}}) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestLoneMarkIsText(t *testing.T) {
+	out := build(t, "# Rules\n\nif a == b then roll, ==always== twice.\n\n- x == y\n", BuilderConfig{})
+	assertContains(t, out, "if a == b then roll, <mark>always</mark> twice.", "x == y")
+
+	if got := inlineItems(lexItems(t, "a == b\n==c==\n")); !reflect.DeepEqual(got, []Item{{typ: ItemMark, val: "c"}}) {
+		t.Errorf("got %v", got)
+	}
+}
@@ -0,0 +1,311 @@
+package rulebook
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// MarkdownBuilder renders a document back to standard Markdown, for tools
+// that do not know the rulebook syntax.
+type MarkdownBuilder struct {
+	content   strings.Builder
+	lists     []int // next number of each open list, 0 for bullet lists.
+	inQuote   bool
+	tableRows int
+	aligns    []string
+	annexes   map[string]string // anchor of the annex headings by link name.
+
+	Labels Labels
+}
+
+func (m *MarkdownBuilder) write(s string) {
+	if m.inQuote {
+		s = strings.Replace(s, "\n", "\n> ", -1)
+	}
+	m.content.WriteString(s)
+}
+
+// lineStart ends the current line unless it is empty.
+func (m *MarkdownBuilder) lineStart() {
+	s := m.content.String()
+	if s != "" && !strings.HasSuffix(s, "\n") {
+		m.content.WriteString("\n")
+	}
+}
+
+// blankLine ends the current block with an empty line.
+func (m *MarkdownBuilder) blankLine() {
+	m.lineStart()
+	s := m.content.String()
+	if s != "" && !strings.HasSuffix(s, "\n\n") {
+		m.content.WriteString("\n")
+	}
+}
+
+func (m *MarkdownBuilder) heading(level int, title string) {
+	m.blankLine()
+	m.write(strings.Repeat("#", level) + " " + title + "\n\n")
+}
+
+func (m *MarkdownBuilder) Begin(document Document) {
+	m.content.Reset()
+	m.lists = nil
+	m.inQuote = false
+	m.collectAnnexes(document)
+}
+
+// collectAnnexes maps the names linking to an annex, its title or its HTML
+// anchor, to the anchor of its Markdown heading. Headings of the same name
+// keep the link, as in HTML.
+func (m *MarkdownBuilder) collectAnnexes(document Document) {
+	headings := map[string]bool{}
+	addSections := func(sections []Section) {
+		for _, section := range sections {
+			headings[anchorName(section.Title)] = true
+			for _, sub := range section.SubSections {
+				headings[anchorName(sub.Title)] = true
+			}
+		}
+	}
+	addSections(document.Sections)
+	for _, chapter := range document.Chapters {
+		headings[anchorName(chapter.Title)] = true
+		addSections(chapter.Sections)
+	}
+
+	m.annexes = map[string]string{}
+	for i, annex := range document.Annexes {
+		anchor := anchorName(m.annexTitle(toAnnex(i), annex.Title))
+		m.annexes[annexAnchorName(annex.Title)] = anchor
+		if name := anchorName(annex.Title); !headings[name] {
+			m.annexes[name] = anchor
+		}
+	}
+}
+
+func (m *MarkdownBuilder) annexTitle(letter string, title string) string {
+	return m.Labels.withDefaults().Annex + " " + letter + ": " + title
+}
+
+func (m *MarkdownBuilder) End() {}
+
+func (m *MarkdownBuilder) Heading(level int, number string, title string) {
+	m.heading(level, title)
+}
+
+func (m *MarkdownBuilder) AnnexOpen(letter string, title string) {
+	m.heading(1, m.annexTitle(letter, title))
+}
+
+func (m *MarkdownBuilder) AnnexClose() {}
+
+func (m *MarkdownBuilder) Command(name string, args []string) {
+	switch name {
+	case "img":
+		if len(args) < 2 {
+			return
+		}
+		m.blankLine()
+		m.write("![" + args[1] + "](" + args[0] + ")")
+		m.blankLine()
+	case "figure":
+		if len(args) < 2 {
+			return
+		}
+		m.blankLine()
+		m.write("![" + strings.Join(args[1:], ", ") + "](" + args[0] + ")")
+		m.blankLine()
+	case "dice":
+		m.write(strings.Join(args, ", "))
+	case "color", "span":
+		if len(args) > 0 {
+			m.write(args[0])
+		}
+	}
+}
+
+// markdownEscaper keeps the literal markup characters of the source, such as
+// an escaped \*, from reading as Markdown.
+var markdownEscaper = strings.NewReplacer("\\", "\\\\", "*", "\\*", "_", "\\_", "[", "\\[", "`", "\\`")
+
+func (m *MarkdownBuilder) Text(s string)   { m.write(markdownEscaper.Replace(s)) }
+func (m *MarkdownBuilder) Bold(s string)   { m.write("**" + s + "**") }
+func (m *MarkdownBuilder) Italic(s string) { m.write("_" + s + "_") }
+func (m *MarkdownBuilder) Em(s string)     { m.write("_" + s + "_") }
+func (m *MarkdownBuilder) Strike(s string) { m.write("~~" + s + "~~") }
+func (m *MarkdownBuilder) Sup(s string)    { m.write("^" + s + "^") }
+func (m *MarkdownBuilder) Sub(s string)    { m.write("~" + s + "~") }
+func (m *MarkdownBuilder) Mark(s string)   { m.write("==" + s + "==") }
+func (m *MarkdownBuilder) Code(s string)   { m.write("`" + s + "`") }
+
+func (m *MarkdownBuilder) Link(text string, target string) {
+	target, _ = splitFlags(target)
+	if !isExternalLink(target) {
+		anchor, ok := m.annexes[anchorName(target)]
+		if !ok {
+			anchor = anchorName(target)
+		}
+		target = "#" + anchor
+	}
+	m.write("[" + text + "](" + target + ")")
+}
+
+func (m *MarkdownBuilder) NewLine() {
+	if m.inQuote {
+		m.write("\n\n")
+		return
+	}
+	m.blankLine()
+}
+
+func (m *MarkdownBuilder) CodeBlock(s string) {
+	m.blankLine()
+	m.write("```\n" + s + "\n```\n\n")
+}
+
+func (m *MarkdownBuilder) QuoteOpen() {
+	m.blankLine()
+	m.inQuote = true
+	m.write("> ")
+}
+
+func (m *MarkdownBuilder) QuoteClose() {
+	m.inQuote = false
+	m.blankLine()
+}
+
+func (m *MarkdownBuilder) Rule() {
+	m.blankLine()
+	m.write("---\n\n")
+}
+
+func (m *MarkdownBuilder) DefListOpen() { m.blankLine() }
+func (m *MarkdownBuilder) DefTerm()     { m.lineStart() }
+
+func (m *MarkdownBuilder) DefDesc() {
+	m.lineStart()
+	m.write(": ")
+}
+
+func (m *MarkdownBuilder) DefListClose() {
+	m.blankLine()
+}
+
+func (m *MarkdownBuilder) ListOpen(style string) {
+	m.lineStart()
+	if style == "decimal" {
+		m.lists = append(m.lists, 1)
+	} else {
+		m.lists = append(m.lists, 0)
+	}
+}
+
+func (m *MarkdownBuilder) ListClose() {
+	m.lists = m.lists[:len(m.lists)-1]
+	if len(m.lists) == 0 {
+		m.blankLine()
+	}
+}
+
+func (m *MarkdownBuilder) ListItemOpen() {
+	m.lineStart()
+	m.write(strings.Repeat("  ", len(m.lists)-1))
+	if n := m.lists[len(m.lists)-1]; n > 0 {
+		m.write(strconv.Itoa(n) + ". ")
+		m.lists[len(m.lists)-1]++
+	} else {
+		m.write("- ")
+	}
+}
+
+func (m *MarkdownBuilder) ListItemClose() {
+	m.lineStart()
+}
+
+func (m *MarkdownBuilder) TableOpen(title string) {
+	title, _ = splitFlags(title)
+	m.blankLine()
+	m.write("**" + title + "**\n\n")
+	m.tableRows = 0
+	m.aligns = nil
+}
+
+func (m *MarkdownBuilder) TableAlign(aligns []string) {
+	m.aligns = aligns
+}
+
+// cellMarkdown renders the inline markup of a table cell on a single line,
+// escaping the | that would end it.
+func (m *MarkdownBuilder) cellMarkdown(cell string) string {
+	items, err := cellItems(cell)
+	if err != nil {
+		return strings.Replace(cell, "|", "\\|", -1)
+	}
+
+	content, inQuote := m.content, m.inQuote
+	m.content, m.inQuote = strings.Builder{}, false
+	for _, it := range items {
+		renderItem(m, it)
+	}
+	s := m.content.String()
+	m.content, m.inQuote = content, inQuote
+
+	s = strings.TrimSpace(strings.Replace(s, "\n", " ", -1))
+
+	return strings.Replace(s, "|", "\\|", -1)
+}
+
+func (m *MarkdownBuilder) TableRow(cells []string) {
+	for i, cell := range cells {
+		cells[i] = m.cellMarkdown(cell)
+	}
+	m.write("| " + strings.Join(cells, " | ") + " |\n")
+	if m.tableRows == 0 {
+		for i := range cells {
+			marker := "---"
+			if i < len(m.aligns) {
+				switch m.aligns[i] {
+				case "left":
+					marker = ":--"
+				case "center":
+					marker = ":-:"
+				case "right":
+					marker = "--:"
+				}
+			}
+			m.write("| " + marker + " ")
+		}
+		m.write("|\n")
+	}
+	m.tableRows++
+}
+
+func (m *MarkdownBuilder) TableClose() {
+	m.blankLine()
+}
+
+func (m *MarkdownBuilder) Build(document Document) (string, error) {
+	Render(document, m)
+
+	return strings.TrimSpace(m.content.String()) + "\n", nil
+}
+
+func BuildMarkdown(input io.Reader, w io.Writer, config BuilderConfig) error {
+	document, err := parse(context.Background(), input, config)
+	if err != nil {
+		return err
+	}
+
+	builder := MarkdownBuilder{Labels: config.Labels}
+
+	out, err := builder.Build(document)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write([]byte(out))
+
+	return err
+}
@@ -0,0 +1,64 @@
+package rulebook
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildMarkdown(t *testing.T) {
+	input := "# Combat\n\nRoll **twice**, __then__ see [attack](Attack).\n\n- one *x*\n  - nested\n- two\n\n-table- Weapons\nName|Damage\nSword|d8\n-table-\n\n\\img(orc.png, An orc)\n\n## Attack\n\nHit.\n\nANNEX Bestiary\n"
+
+	var out strings.Builder
+	if err := BuildMarkdown(strings.NewReader(input), &out, BuilderConfig{}); err != nil {
+		t.Fatalf("markdown: %v", err)
+	}
+
+	want := "# Combat\n\n" +
+		"Roll **twice**, _then_ see [attack](#attack).\n\n" +
+		"- one _x_\n  - nested\n- two\n\n" +
+		"**Weapons**\n\n| Name | Damage |\n| --- | --- |\n| Sword | d8 |\n\n" +
+		"![An orc](orc.png)\n\n" +
+		"## Attack\n\nHit.\n\n" +
+		"# Annexe A: Bestiary\n"
+	if out.String() != want {
+		t.Errorf("markdown:\ngot  %q\nwant %q", out.String(), want)
+	}
+}
+
+func TestBuildMarkdownEscapesLiterals(t *testing.T) {
+	var out strings.Builder
+	if err := BuildMarkdown(strings.NewReader("# Combat\n\nprice: 5\\* bonus, snake\\_case \\[x]\n"), &out, BuilderConfig{}); err != nil {
+		t.Fatalf("markdown: %v", err)
+	}
+
+	if want := "# Combat\n\nprice: 5\\* bonus, snake\\_case \\[x]\n"; out.String() != want {
+		t.Errorf("markdown:\ngot  %q\nwant %q", out.String(), want)
+	}
+}
+
+func TestBuildMarkdownLinksToAnnex(t *testing.T) {
+	var out strings.Builder
+	if err := BuildMarkdown(strings.NewReader("# Combat\n\nSee [z](Z) and [orcs](annex-bestiary).\n\nANNEX Z\n\nANNEX Bestiary\n"), &out, BuilderConfig{}); err != nil {
+		t.Fatalf("markdown: %v", err)
+	}
+
+	if want := "See [z](#annexe-a-z) and [orcs](#annexe-b-bestiary)."; !strings.Contains(out.String(), want) {
+		t.Errorf("markdown:\ngot  %q\nwant %q", out.String(), want)
+	}
+}
+
+func TestBuildMarkdownTableCells(t *testing.T) {
+	input := "# Combat\n\n-table- Foes\nName|Note\n[Orc](combat) \\anchor(orc) **big**|d8 \\| d10\n-table-\n"
+
+	var out strings.Builder
+	if err := BuildMarkdown(strings.NewReader(input), &out, BuilderConfig{}); err != nil {
+		t.Fatalf("markdown: %v", err)
+	}
+
+	if want := "| [Orc](#combat)  **big** | d8 \\| d10 |\n"; !strings.Contains(out.String(), want) {
+		t.Errorf("markdown:\ngot  %q\nwant %q", out.String(), want)
+	}
+	if strings.Contains(out.String(), "anchor") {
+		t.Errorf("markdown: command left in %q", out.String())
+	}
+}
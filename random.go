@@ -0,0 +1,174 @@
+package rulebook
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type randomTable struct {
+	die     string
+	faces   int
+	covered []int
+	line    int
+}
+
+// maxDieFaces bounds random tables, which keep a counter per face.
+const maxDieFaces = 1000
+
+func parseDie(s string) (int, error) {
+	s = strings.TrimPrefix(s, "die=")
+	if len(s) < 2 || s[0] != 'd' {
+		return 0, fmt.Errorf("invalid die %q", s)
+	}
+
+	if s[1:] == "%" {
+		return 100, nil
+	}
+
+	faces, err := strconv.Atoi(s[1:])
+	if err != nil || faces < 2 {
+		return 0, fmt.Errorf("invalid die %q", s)
+	}
+	if faces > maxDieFaces {
+		return 0, fmt.Errorf("die %q has more than %d faces", s, maxDieFaces)
+	}
+
+	return faces, nil
+}
+
+// parseDice checks dice notation such as 2d6+1, d8 or d%: an optional count,
+// a die and an optional +K or -K modifier.
+func parseDice(s string) error {
+	d := strings.IndexByte(s, 'd')
+	if d < 0 || (d > 0 && !isNumber(s[:d])) {
+		return fmt.Errorf("invalid dice %q", s)
+	}
+	if d > 0 {
+		if n, _ := strconv.Atoi(s[:d]); n < 1 {
+			return fmt.Errorf("invalid dice %q", s)
+		}
+	}
+
+	die := s[d+1:]
+	if sign := strings.IndexAny(die, "+-"); sign >= 0 {
+		if !isNumber(die[sign+1:]) {
+			return fmt.Errorf("invalid dice %q", s)
+		}
+		die = die[:sign]
+	}
+
+	if die == "%" {
+		return nil
+	}
+	if faces, err := strconv.Atoi(die); err != nil || !isNumber(die) || faces < 2 {
+		return fmt.Errorf("invalid dice %q", s)
+	}
+
+	return nil
+}
+
+func isNumber(s string) bool {
+	return s != "" && strings.Trim(s, "0123456789") == ""
+}
+
+func (t *randomTable) face(s string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid roll %q", s)
+	}
+
+	// d100 tables traditionally write 100 as 00
+	if n == 0 && t.faces == 100 {
+		n = 100
+	}
+
+	return n, nil
+}
+
+// parseRange reads a roll range such as 5, 01-40 or 71-00.
+func (t *randomTable) parseRange(s string) (int, int, error) {
+	bounds := strings.SplitN(s, "-", 2)
+
+	low, err := t.face(bounds[0])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	high := low
+	if len(bounds) == 2 {
+		high, err = t.face(bounds[1])
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if high < low {
+		return 0, 0, fmt.Errorf("invalid range %q", s)
+	}
+
+	return low, high, nil
+}
+
+// cover marks the faces of a range as used and returns the problems found.
+func (t *randomTable) cover(low int, high int) []string {
+	var problems []string
+
+	if low < 1 || high > t.faces {
+		problems = append(problems, fmt.Sprintf("range %d-%d is outside of %s", low, high, t.die))
+	}
+
+	from, to := low, high
+	if from < 1 {
+		from = 1
+	}
+	if to > t.faces {
+		to = t.faces
+	}
+
+	var overlap []int
+	for n := from; n <= to; n++ {
+		if t.covered[n] > 0 {
+			overlap = append(overlap, n)
+		}
+		t.covered[n]++
+	}
+
+	if len(overlap) > 0 {
+		problems = append(problems, fmt.Sprintf("range %d-%d overlaps on %s", low, high, formatRanges(overlap)))
+	}
+
+	return problems
+}
+
+// gaps lists the faces of the die that no row covers.
+func (t *randomTable) gaps() []int {
+	var gaps []int
+	for n := 1; n <= t.faces; n++ {
+		if t.covered[n] == 0 {
+			gaps = append(gaps, n)
+		}
+	}
+
+	return gaps
+}
+
+// formatRanges writes sorted faces as compact ranges: 1-3, 7, 9-10.
+func formatRanges(faces []int) string {
+	var ranges []string
+
+	for i := 0; i < len(faces); i++ {
+		start := faces[i]
+		for i+1 < len(faces) && faces[i+1] == faces[i]+1 {
+			i++
+		}
+
+		if start == faces[i] {
+			ranges = append(ranges, strconv.Itoa(start))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", start, faces[i]))
+		}
+	}
+
+	return strings.Join(ranges, ", ")
+}
@@ -0,0 +1,98 @@
+package rulebook
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseDie(t *testing.T) {
+	tests := []struct {
+		die   string
+		faces int
+		err   bool
+	}{
+		{die: "d6", faces: 6},
+		{die: "die=d100", faces: 100},
+		{die: "d%", faces: 100},
+		{die: "d1000", faces: 1000},
+		{die: "d1001", err: true},
+		{die: "d999999999", err: true},
+		{die: "d1", err: true},
+		{die: "6", err: true},
+		{die: "dx", err: true},
+	}
+
+	for _, test := range tests {
+		faces, err := parseDie(test.die)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseDie(%q): expected an error, got %d faces", test.die, faces)
+			}
+			continue
+		}
+		if err != nil || faces != test.faces {
+			t.Errorf("parseDie(%q) = %d, %v, want %d", test.die, faces, err, test.faces)
+		}
+	}
+}
+
+func TestParseDice(t *testing.T) {
+	tests := []struct {
+		dice string
+		err  bool
+	}{
+		{dice: "2d6+1"},
+		{dice: "3d8-2"},
+		{dice: "d20"},
+		{dice: "d%"},
+		{dice: "4d%+10"},
+		{dice: "2x6", err: true},
+		{dice: "2d", err: true},
+		{dice: "0d6", err: true},
+		{dice: "d1", err: true},
+		{dice: "2d6+", err: true},
+		{dice: "2d6*2", err: true},
+		{dice: "-1d6", err: true},
+	}
+
+	for _, test := range tests {
+		if err := parseDice(test.dice); (err != nil) != test.err {
+			t.Errorf("parseDice(%q) = %v, want error %v", test.dice, err, test.err)
+		}
+	}
+}
+
+func TestRandomTableWeights(t *testing.T) {
+	input := "# Encounters\n\n\\rtable(die=d100, Forest)\n\\roll(01-40, Wolves)\n\\roll(41-00, Bandits)\n\\end()\n"
+
+	out := build(t, input, BuilderConfig{})
+	assertContains(t, out,
+		"<table class='random-table'>",
+		"<th colspan='3'>Forest</th>",
+		"<td class='head'>01-40</td>\n<td class='lead'>Wolves</td>\n<td class='weight'>40%</td>",
+		"<td class='head'>41-00</td>\n<td class='lead'>Bandits</td>\n<td class='weight'>60%</td>",
+	)
+
+	if warnings := lint(t, input, BuilderConfig{}); len(warnings) > 0 {
+		t.Errorf("unexpected warnings: %v", warnings)
+	}
+}
+
+func TestRandomTableOverlapsAndGaps(t *testing.T) {
+	input := "# Encounters\n\n\\rtable(d100)\n\\roll(01-50, Wolves)\n\\roll(41-80, Bandits)\n\\roll(91-00, Dragon)\n\\end()\n"
+
+	warnings := strings.Join(lint(t, input, BuilderConfig{}), "\n")
+	assertContains(t, warnings, "range 41-80 overlaps on 41-50", "d100 does not cover 81-90")
+}
+
+func TestRandomTableOutOfRange(t *testing.T) {
+	input := "# Encounters\n\n\\rtable(d6)\n\\roll(1-999999999, Everything)\n\\end()\n"
+
+	warnings := strings.Join(lint(t, input, BuilderConfig{}), "\n")
+	assertContains(t, warnings, "range 1-999999999 is outside of d6")
+}
+
+func TestRandomTableTooManyFaces(t *testing.T) {
+	err := buildError(t, "# Encounters\n\n\\rtable(d999999999)\n\\end()\n", BuilderConfig{})
+	assertContains(t, err, "line 3", "rtable", "more than 1000 faces")
+}
@@ -0,0 +1,237 @@
+package rulebook
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Renderer receives the content of a document in reading order from Render.
+// HTMLRenderer is the one Build uses, TextBuilder and MarkdownBuilder are
+// others.
+//
+// The items before the first heading come right after Begin.
+// Heading levels are 1 for chapters, 2 for sections and 3 for sub-sections;
+// number is the chapter or annex section number, empty when there is none.
+// Table cells are given as written, with their inline markup; cellText
+// strips it.
+// TableAlign, when given, comes before the rows with the left, center, right
+// or empty alignment of each column.
+// DefTerm and DefDesc start a term or a definition of the current definition
+// list, running up to the next one or to DefListClose.
+// Link targets and table titles are given as written, with their trailing
+// {flag} hints.
+type Renderer interface {
+	Begin(document Document)
+	End()
+	Heading(level int, number string, title string)
+	AnnexOpen(letter string, title string)
+	AnnexClose()
+	Text(s string)
+	Bold(s string)
+	Italic(s string)
+	Em(s string)
+	Strike(s string)
+	Sup(s string)
+	Sub(s string)
+	Mark(s string)
+	Code(s string)
+	CodeBlock(s string)
+	Link(text string, target string)
+	Command(name string, args []string)
+	NewLine()
+	ListOpen(style string)
+	ListItemOpen()
+	ListItemClose()
+	ListClose()
+	TableOpen(title string)
+	TableAlign(aligns []string)
+	TableRow(cells []string)
+	TableClose()
+	QuoteOpen()
+	QuoteClose()
+	Rule()
+	DefListOpen()
+	DefTerm()
+	DefDesc()
+	DefListClose()
+}
+
+// Render walks a document and hands its content to r.
+func Render(document Document, r Renderer) {
+	render(context.Background(), document, r)
+}
+
+// render walks the document like Render, stopping with the context error
+// once ctx is done.
+func render(ctx context.Context, document Document, r Renderer) error {
+	r.Begin(document)
+
+	if err := renderItems(ctx, r, document.Items); err != nil {
+		return err
+	}
+
+	for _, section := range document.Sections {
+		if err := renderSection(ctx, r, section, ""); err != nil {
+			return err
+		}
+	}
+
+	for chapterIndex, chapter := range document.Chapters {
+		r.Heading(1, toRoman(chapterIndex+1), chapter.Title)
+		if err := renderItems(ctx, r, chapter.Items); err != nil {
+			return err
+		}
+		for _, section := range chapter.Sections {
+			if err := renderSection(ctx, r, section, ""); err != nil {
+				return err
+			}
+		}
+	}
+
+	for annexIndex, annex := range document.Annexes {
+		r.AnnexOpen(toAnnex(annexIndex), annex.Title)
+		if err := renderItems(ctx, r, annex.Items); err != nil {
+			return err
+		}
+		for sectionIndex, section := range annex.Sections {
+			if err := renderSection(ctx, r, section, annexSectionNumber(annexIndex, sectionIndex)); err != nil {
+				return err
+			}
+		}
+		r.AnnexClose()
+	}
+
+	r.End()
+
+	return nil
+}
+
+func renderSection(ctx context.Context, r Renderer, section Section, number string) error {
+	r.Heading(2, number, section.Title)
+	if err := renderItems(ctx, r, section.Items); err != nil {
+		return err
+	}
+	for subIndex, sub := range section.SubSections {
+		r.Heading(3, subSectionNumber(number, subIndex), sub.Title)
+		if err := renderItems(ctx, r, sub.Items); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func subSectionNumber(number string, subIndex int) string {
+	if number == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("%s.%d", number, subIndex+1)
+}
+
+// lineSetter is implemented by renderers reporting errors with the line of
+// the item being rendered.
+type lineSetter interface {
+	setLine(line int)
+}
+
+func renderItems(ctx context.Context, r Renderer, items []Item) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	lines, _ := r.(lineSetter)
+	for _, it := range items {
+		if lines != nil {
+			lines.setLine(it.line)
+		}
+		renderItem(r, it)
+	}
+
+	return nil
+}
+
+// cellText is the text of a table cell without its markup.
+func cellText(cell string) string {
+	items, err := cellItems(cell)
+	if err != nil {
+		return cell
+	}
+
+	text := ""
+	for _, it := range items {
+		switch it.typ {
+		case ItemLink:
+			text += strings.Split(it.val, "|")[0]
+		case ItemCommand:
+		default:
+			text += it.val
+		}
+	}
+
+	return text
+}
+
+func renderItem(r Renderer, it Item) {
+	switch it.typ {
+	case ItemText:
+		r.Text(it.val)
+	case ItemBold:
+		r.Bold(it.val)
+	case ItemItalic:
+		r.Italic(it.val)
+	case ItemEm:
+		r.Em(it.val)
+	case ItemStrike:
+		r.Strike(it.val)
+	case ItemSup:
+		r.Sup(it.val)
+	case ItemSub:
+		r.Sub(it.val)
+	case ItemMark:
+		r.Mark(it.val)
+	case ItemCode:
+		r.Code(it.val)
+	case ItemCodeBlock:
+		r.CodeBlock(it.val)
+	case ItemLink:
+		info := strings.Split(it.val, "|")
+		r.Link(info[0], info[1])
+	case ItemCommand:
+		info := strings.SplitN(it.val, "|", 2)
+		r.Command(info[0], commandArgs(info[0], info[1]))
+	case ItemNewLine:
+		r.NewLine()
+	case ItemListOpen:
+		r.ListOpen(it.val)
+	case ItemStartListElement:
+		r.ListItemOpen()
+	case ItemEndListElement:
+		r.ListItemClose()
+	case ItemListClose:
+		r.ListClose()
+	case ItemTableStart:
+		r.TableOpen(it.val)
+	case ItemTableAlign:
+		r.TableAlign(strings.Split(it.val, "|"))
+	case ItemTableRow:
+		r.TableRow(splitCells(it.val))
+	case ItemTableEnd:
+		r.TableClose()
+	case ItemQuoteOpen:
+		r.QuoteOpen()
+	case ItemQuoteClose:
+		r.QuoteClose()
+	case ItemRule:
+		r.Rule()
+	case ItemDefListOpen:
+		r.DefListOpen()
+	case ItemDefTerm:
+		r.DefTerm()
+	case ItemDefDesc:
+		r.DefDesc()
+	case ItemDefListClose:
+		r.DefListClose()
+	}
+}
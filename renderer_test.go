@@ -0,0 +1,94 @@
+package rulebook
+
+import (
+	"strings"
+	"testing"
+)
+
+// bbcodeRenderer is a minimal forum renderer proving a Renderer can be plugged
+// in; whatever it does not handle is left out.
+type bbcodeRenderer struct {
+	out strings.Builder
+}
+
+func (r *bbcodeRenderer) Begin(document Document) {}
+func (r *bbcodeRenderer) End()                    {}
+
+func (r *bbcodeRenderer) Heading(level int, number string, title string) {
+	r.out.WriteString("[h" + strings.Repeat("=", level) + "]" + title + "[/h]\n")
+}
+
+func (r *bbcodeRenderer) AnnexOpen(letter string, title string) {
+	r.out.WriteString("[h]" + letter + " " + title + "[/h]\n")
+}
+
+func (r *bbcodeRenderer) AnnexClose()        {}
+func (r *bbcodeRenderer) Text(s string)      { r.out.WriteString(s) }
+func (r *bbcodeRenderer) Bold(s string)      { r.out.WriteString("[b]" + s + "[/b]") }
+func (r *bbcodeRenderer) Italic(s string)    { r.out.WriteString("[i]" + s + "[/i]") }
+func (r *bbcodeRenderer) Em(s string)        { r.out.WriteString("[i]" + s + "[/i]") }
+func (r *bbcodeRenderer) Strike(s string)    { r.out.WriteString("[s]" + s + "[/s]") }
+func (r *bbcodeRenderer) Sup(s string)       { r.out.WriteString(s) }
+func (r *bbcodeRenderer) Sub(s string)       { r.out.WriteString(s) }
+func (r *bbcodeRenderer) Mark(s string)      { r.out.WriteString(s) }
+func (r *bbcodeRenderer) Code(s string)      { r.out.WriteString("[code]" + s + "[/code]") }
+func (r *bbcodeRenderer) CodeBlock(s string) { r.out.WriteString("[code]" + s + "[/code]\n") }
+func (r *bbcodeRenderer) Link(text string, target string) {
+	r.out.WriteString("[url=#" + target + "]" + text + "[/url]")
+}
+func (r *bbcodeRenderer) Command(name string, args []string) {}
+func (r *bbcodeRenderer) NewLine()                           { r.out.WriteString("\n") }
+func (r *bbcodeRenderer) ListOpen(style string)              { r.out.WriteString("[list]\n") }
+func (r *bbcodeRenderer) ListItemOpen()                      { r.out.WriteString("[*]") }
+func (r *bbcodeRenderer) ListItemClose()                     { r.out.WriteString("\n") }
+func (r *bbcodeRenderer) ListClose()                         { r.out.WriteString("[/list]\n") }
+func (r *bbcodeRenderer) TableOpen(title string)             {}
+func (r *bbcodeRenderer) TableAlign(aligns []string)         {}
+func (r *bbcodeRenderer) TableRow(cells []string)            {}
+func (r *bbcodeRenderer) TableClose()                        {}
+func (r *bbcodeRenderer) QuoteOpen()                         { r.out.WriteString("[quote]") }
+func (r *bbcodeRenderer) QuoteClose()                        { r.out.WriteString("[/quote]\n") }
+func (r *bbcodeRenderer) Rule()                              { r.out.WriteString("[hr]\n") }
+func (r *bbcodeRenderer) DefListOpen()                       {}
+func (r *bbcodeRenderer) DefTerm()                           {}
+func (r *bbcodeRenderer) DefDesc()                           {}
+func (r *bbcodeRenderer) DefListClose()                      {}
+
+func TestCustomRenderer(t *testing.T) {
+	document, err := Parse(strings.NewReader("# Combat\n\n## Attack\n\nRoll **twice**, see [Damage](damage).\n\n- one\n- two\n"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	var r bbcodeRenderer
+	Render(document, &r)
+
+	assertContains(t, r.out.String(),
+		"[h=]Combat[/h]\n",
+		"[h==]Attack[/h]\n",
+		"Roll [b]twice[/b], see [url=#damage]Damage[/url].",
+		"[list]\n[*]one\n[*]two\n[/list]\n",
+	)
+}
+
+func TestHTMLRendererStandalone(t *testing.T) {
+	input := "# Combat\n\n## Attack\n\nRoll **twice**, see [Nowhere](nowhere).\n"
+	document, err := Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	var out strings.Builder
+	r := HTMLRenderer{Builder: &Builder{}, W: &out}
+	Render(document, r)
+
+	if want := build(t, input, BuilderConfig{}); out.String() != want {
+		t.Errorf("standalone output differs from Build:\ngot  %q\nwant %q", out.String(), want)
+	}
+
+	discard := HTMLRenderer{Builder: &Builder{}}
+	Render(document, discard)
+	if len(discard.Warnings) != 1 {
+		t.Errorf("expected the unknown link warning, got %v", discard.Warnings)
+	}
+}
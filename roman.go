@@ -1,5 +1,7 @@
 package rulebook
 
+import "fmt"
+
 var num = map[string]int{
 	"I": 1,
 	"V": 5,
@@ -42,8 +44,13 @@ var maxTable = []int{
 	1,
 }
 
-// ToRoman is to convert decimal number to roman numeral
+// ToRoman is to convert decimal number to roman numeral. Numbers below 1
+// have no roman numeral and give an empty string.
 func toRoman(n int) string {
+	if n < 1 {
+		return ""
+	}
+
 	out := ""
 	for n > 0 {
 		v := highestDecimal(n)
@@ -53,6 +60,34 @@ func toRoman(n int) string {
 	return out
 }
 
+// FromRoman parses a roman numeral such as XIV. Only the canonical
+// subtractive form is accepted: IIII or IC are errors.
+func FromRoman(s string) (int, error) {
+	if s == "" {
+		return 0, fmt.Errorf("empty roman numeral")
+	}
+
+	n := 0
+	for i := 0; i < len(s); i++ {
+		v, ok := num[s[i:i+1]]
+		if !ok {
+			return 0, fmt.Errorf("invalid roman numeral %q", s)
+		}
+
+		if i+1 < len(s) && v < num[s[i+1:i+2]] {
+			n -= v
+		} else {
+			n += v
+		}
+	}
+
+	if toRoman(n) != s {
+		return 0, fmt.Errorf("invalid roman numeral %q", s)
+	}
+
+	return n, nil
+}
+
 func highestDecimal(n int) int {
 	for _, v := range maxTable {
 		if v <= n {
@@ -61,3 +96,14 @@ func highestDecimal(n int) int {
 	}
 	return 1
 }
+
+// toAnnex converts a zero-based annex index to a letter, continuing with
+// AA, AB, ... past Z like spreadsheet columns.
+func toAnnex(n int) string {
+	out := ""
+	for n >= 0 {
+		out = string(rune('A'+n%26)) + out
+		n = n/26 - 1
+	}
+	return out
+}
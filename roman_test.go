@@ -0,0 +1,118 @@
+package rulebook
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestToAnnex(t *testing.T) {
+	tests := []struct {
+		n      int
+		letter string
+	}{
+		{n: 0, letter: "A"},
+		{n: 25, letter: "Z"},
+		{n: 26, letter: "AA"},
+		{n: 27, letter: "AB"},
+		{n: 52, letter: "BA"},
+		{n: 701, letter: "ZZ"},
+		{n: 702, letter: "AAA"},
+	}
+
+	for _, test := range tests {
+		if letter := toAnnex(test.n); letter != test.letter {
+			t.Errorf("toAnnex(%d) = %q, want %q", test.n, letter, test.letter)
+		}
+	}
+}
+
+func TestAnnexLettersInTableOfContents(t *testing.T) {
+	var input strings.Builder
+	input.WriteString("# Rules\n\n")
+	for i := 0; i < 53; i++ {
+		fmt.Fprintf(&input, "ANNEX Annex %d\n\n", i)
+	}
+
+	out := build(t, input.String(), BuilderConfig{TableOfContents: true})
+	for _, want := range []struct {
+		n      int
+		letter string
+	}{
+		{n: 0, letter: "A"},
+		{n: 25, letter: "Z"},
+		{n: 26, letter: "AA"},
+		{n: 27, letter: "AB"},
+		{n: 52, letter: "BA"},
+	} {
+		assertContains(t, out,
+			fmt.Sprintf("<li><strong>Annexe %s</strong>: <a href='#annex-annex-%d'>Annex %d</a></li>", want.letter, want.n, want.n),
+			fmt.Sprintf("Annexe %s: Annex %d</h2>", want.letter, want.n),
+		)
+	}
+	assertNotContains(t, out, "Annexe [", "Annexe \\")
+}
+
+func TestToRoman(t *testing.T) {
+	tests := []struct {
+		n     int
+		roman string
+	}{
+		{n: -3, roman: ""},
+		{n: 0, roman: ""},
+		{n: 1, roman: "I"},
+		{n: 4, roman: "IV"},
+		{n: 9, roman: "IX"},
+		{n: 14, roman: "XIV"},
+		{n: 40, roman: "XL"},
+		{n: 1994, roman: "MCMXCIV"},
+		{n: 3999, roman: "MMMCMXCIX"},
+	}
+
+	for _, test := range tests {
+		if roman := toRoman(test.n); roman != test.roman {
+			t.Errorf("toRoman(%d) = %q, want %q", test.n, roman, test.roman)
+		}
+	}
+}
+
+func TestFromRoman(t *testing.T) {
+	tests := []struct {
+		roman string
+		n     int
+		err   string
+	}{
+		{roman: "I", n: 1},
+		{roman: "IV", n: 4},
+		{roman: "IX", n: 9},
+		{roman: "XL", n: 40},
+		{roman: "XIV", n: 14},
+		{roman: "MCMXCIV", n: 1994},
+		{roman: "MMMCMXCIX", n: 3999},
+		{roman: "", err: "empty roman numeral"},
+		{roman: "IIII", err: "invalid roman numeral \"IIII\""},
+		{roman: "IC", err: "invalid roman numeral \"IC\""},
+		{roman: "VV", err: "invalid roman numeral \"VV\""},
+		{roman: "iv", err: "invalid roman numeral \"iv\""},
+		{roman: "X1", err: "invalid roman numeral \"X1\""},
+	}
+
+	for _, test := range tests {
+		n, err := FromRoman(test.roman)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("FromRoman(%q) = %d, %v, want error %q", test.roman, n, err, test.err)
+			}
+			continue
+		}
+		if err != nil || n != test.n {
+			t.Errorf("FromRoman(%q) = %d, %v, want %d", test.roman, n, err, test.n)
+		}
+	}
+
+	for n := 1; n < 4000; n++ {
+		if back, err := FromRoman(toRoman(n)); err != nil || back != n {
+			t.Errorf("FromRoman(toRoman(%d)) = %d, %v", n, back, err)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package rulebook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+)
+
+type SitemapEntry struct {
+	Kind     string         `json:"kind"`
+	Title    string         `json:"title"`
+	Anchor   string         `json:"anchor"`
+	Children []SitemapEntry `json:"children,omitempty"`
+}
+
+// Sitemap lists every linkable target of the document with the anchors the
+// builder generates for it. \anchor() targets are listed under the heading
+// they appear after, at the top level when they come before the first one.
+func (b *Builder) Sitemap(document Document) []SitemapEntry {
+	b.collectTargets(document)
+	anchors := headingAnchors{anchors: b.headings.anchors}
+	entries := append([]SitemapEntry{}, b.anchorEntries(document.Items)...)
+
+	for _, section := range document.Sections {
+		entries = append(entries, b.sectionEntry(section, &anchors))
+	}
+
+	for _, chapter := range document.Chapters {
+		entry := SitemapEntry{Kind: "chapter", Title: chapter.Title, Anchor: anchors.take()}
+		entry.Children = b.anchorEntries(chapter.Items)
+		for _, section := range chapter.Sections {
+			entry.Children = append(entry.Children, b.sectionEntry(section, &anchors))
+		}
+		entries = append(entries, entry)
+	}
+
+	for _, annex := range document.Annexes {
+		entry := SitemapEntry{Kind: "annex", Title: annex.Title, Anchor: anchors.take()}
+		entry.Children = b.anchorEntries(annex.Items)
+		for _, section := range annex.Sections {
+			entry.Children = append(entry.Children, b.sectionEntry(section, &anchors))
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+func (b *Builder) sectionEntry(section Section, anchors *headingAnchors) SitemapEntry {
+	entry := SitemapEntry{Kind: "section", Title: section.Title, Anchor: anchors.take()}
+	entry.Children = b.anchorEntries(section.Items)
+	for _, sub := range section.SubSections {
+		subEntry := SitemapEntry{Kind: "subsection", Title: sub.Title, Anchor: anchors.take()}
+		subEntry.Children = b.anchorEntries(sub.Items)
+		entry.Children = append(entry.Children, subEntry)
+	}
+
+	return entry
+}
+
+// anchorEntries lists the \anchor() targets of items, leaving out the ones
+// that clash with a heading or an earlier anchor.
+func (b *Builder) anchorEntries(items []Item) []SitemapEntry {
+	var entries []SitemapEntry
+	for _, name := range anchorNames(items) {
+		t, ok := b.targets[name]
+		if !ok || !t.inline || t.claimed {
+			continue
+		}
+		t.claimed = true
+		b.targets[name] = t
+		entries = append(entries, SitemapEntry{Kind: "anchor", Title: t.title, Anchor: t.anchor})
+	}
+
+	return entries
+}
+
+func BuildSitemap(input io.Reader, w io.Writer, config BuilderConfig) error {
+	document, err := parse(context.Background(), input, config)
+	if err != nil {
+		return err
+	}
+
+	builder := Builder{Config: config}
+
+	return json.NewEncoder(w).Encode(builder.Sitemap(document))
+}
@@ -0,0 +1,80 @@
+package rulebook
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSitemap(t *testing.T) {
+	input := "# Combat\n\nIntro \\anchor(initiative-rule).\n\n## Attack\n\n### Critical Hits\n\n-table- Criticals\nRoll|Effect \\anchor(crit-table)\n20|Double\n-table-\n\n## Attack\n\nANNEX Bestiary\n\n## Orcs\n\n\\anchor(orc-stats)\n"
+
+	var out strings.Builder
+	if err := BuildSitemap(strings.NewReader(input), &out, BuilderConfig{}); err != nil {
+		t.Fatalf("sitemap: %v", err)
+	}
+
+	var entries []SitemapEntry
+	if err := json.Unmarshal([]byte(out.String()), &entries); err != nil {
+		t.Fatalf("sitemap: %v", err)
+	}
+
+	want := []SitemapEntry{
+		{Kind: "chapter", Title: "Combat", Anchor: "combat", Children: []SitemapEntry{
+			{Kind: "anchor", Title: "initiative-rule", Anchor: "initiative-rule"},
+			{Kind: "section", Title: "Attack", Anchor: "attack", Children: []SitemapEntry{
+				{Kind: "subsection", Title: "Critical Hits", Anchor: "critical-hits", Children: []SitemapEntry{
+					{Kind: "anchor", Title: "crit-table", Anchor: "crit-table"},
+				}},
+			}},
+			{Kind: "section", Title: "Attack", Anchor: "attack-2"},
+		}},
+		{Kind: "annex", Title: "Bestiary", Anchor: "annex-bestiary", Children: []SitemapEntry{
+			{Kind: "section", Title: "Orcs", Anchor: "orcs", Children: []SitemapEntry{
+				{Kind: "anchor", Title: "orc-stats", Anchor: "orc-stats"},
+			}},
+		}},
+	}
+
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("sitemap:\ngot  %+v\nwant %+v", entries, want)
+	}
+}
+
+func TestSitemapSkipsClashingAnchors(t *testing.T) {
+	document, err := Parse(strings.NewReader("# Combat\n\n\\anchor(combat) \\anchor(spot) \\anchor(spot)\n"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	builder := Builder{}
+	entries := builder.Sitemap(document)
+	if len(entries) != 1 || len(entries[0].Children) != 1 || entries[0].Children[0].Anchor != "spot" {
+		t.Errorf("expected only the first spot anchor, got %+v", entries)
+	}
+}
+
+func TestSitemapPrefaceAnchor(t *testing.T) {
+	input := "Read this first \\anchor(preface).\n\n# Combat\n\nSee [the preface](preface).\n"
+
+	document, err := Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	builder := Builder{}
+	want := []SitemapEntry{
+		{Kind: "anchor", Title: "preface", Anchor: "preface"},
+		{Kind: "chapter", Title: "Combat", Anchor: "combat"},
+	}
+	if entries := builder.Sitemap(document); !reflect.DeepEqual(entries, want) {
+		t.Errorf("sitemap:\ngot  %+v\nwant %+v", entries, want)
+	}
+
+	out := build(t, input, BuilderConfig{})
+	assertContains(t, out, "Read this first <a id='preface'></a>.", "<a href='#preface'>the preface</a>")
+	if warnings := lint(t, input, BuilderConfig{}); len(warnings) > 0 {
+		t.Errorf("unexpected warnings: %v", warnings)
+	}
+}
@@ -0,0 +1,162 @@
+package rulebook
+
+import (
+	"context"
+	"io"
+	"strings"
+)
+
+// TextBuilder renders a document as plain text with the markup stripped,
+// for search indexing.
+type TextBuilder struct {
+	content   strings.Builder
+	listDepth int
+
+	Labels Labels
+}
+
+func (t *TextBuilder) write(s string) {
+	t.content.WriteString(s)
+}
+
+// newLine ends the current line, keeping at most one blank line in a row.
+func (t *TextBuilder) newLine() {
+	s := t.content.String()
+	if s == "" || strings.HasSuffix(s, "\n\n") {
+		return
+	}
+	t.content.WriteString("\n")
+}
+
+// lineStart ends the current line unless it is empty.
+func (t *TextBuilder) lineStart() {
+	s := t.content.String()
+	if s != "" && !strings.HasSuffix(s, "\n") {
+		t.content.WriteString("\n")
+	}
+}
+
+func (t *TextBuilder) heading(title string) {
+	t.newLine()
+	t.newLine()
+	t.write(title)
+	t.content.WriteString("\n\n")
+}
+
+func (t *TextBuilder) Begin(document Document) {
+	t.content.Reset()
+	t.listDepth = 0
+}
+
+func (t *TextBuilder) End() {}
+
+func (t *TextBuilder) Heading(level int, number string, title string) {
+	if number != "" {
+		t.heading(number + " - " + title)
+	} else {
+		t.heading(title)
+	}
+}
+
+func (t *TextBuilder) AnnexOpen(letter string, title string) {
+	t.heading(t.Labels.withDefaults().Annex + " " + letter + ": " + title)
+}
+
+func (t *TextBuilder) AnnexClose() {}
+
+func (t *TextBuilder) Text(s string)   { t.write(s) }
+func (t *TextBuilder) Bold(s string)   { t.write(s) }
+func (t *TextBuilder) Italic(s string) { t.write(s) }
+func (t *TextBuilder) Em(s string)     { t.write(s) }
+func (t *TextBuilder) Strike(s string) { t.write(s) }
+func (t *TextBuilder) Sup(s string)    { t.write(s) }
+func (t *TextBuilder) Sub(s string)    { t.write(s) }
+func (t *TextBuilder) Mark(s string)   { t.write(s) }
+func (t *TextBuilder) Code(s string)   { t.write(s) }
+
+func (t *TextBuilder) CodeBlock(s string) {
+	t.lineStart()
+	t.write(s)
+	t.lineStart()
+}
+
+func (t *TextBuilder) Link(text string, target string) {
+	t.write(text)
+}
+
+func (t *TextBuilder) Command(name string, args []string) {}
+
+func (t *TextBuilder) NewLine()    { t.newLine() }
+func (t *TextBuilder) QuoteOpen()  { t.newLine() }
+func (t *TextBuilder) QuoteClose() { t.newLine() }
+func (t *TextBuilder) Rule()       { t.newLine() }
+
+func (t *TextBuilder) DefListOpen()  { t.lineStart() }
+func (t *TextBuilder) DefTerm()      { t.lineStart() }
+func (t *TextBuilder) DefListClose() { t.lineStart() }
+
+func (t *TextBuilder) DefDesc() {
+	t.lineStart()
+	t.write("  ")
+}
+
+func (t *TextBuilder) ListOpen(style string) {
+	t.lineStart()
+	t.listDepth++
+}
+
+func (t *TextBuilder) ListClose() {
+	t.listDepth--
+}
+
+func (t *TextBuilder) ListItemOpen() {
+	t.lineStart()
+	t.write(strings.Repeat("  ", t.listDepth-1) + "- ")
+}
+
+func (t *TextBuilder) ListItemClose() {
+	t.lineStart()
+}
+
+func (t *TextBuilder) TableOpen(title string) {
+	title, _ = splitFlags(title)
+	t.lineStart()
+	t.write(title)
+	t.lineStart()
+}
+
+func (t *TextBuilder) TableRow(cells []string) {
+	for i, cell := range cells {
+		cells[i] = cellText(cell)
+	}
+	t.write(strings.Join(cells, "\t"))
+	t.content.WriteString("\n")
+}
+
+func (t *TextBuilder) TableAlign(aligns []string) {}
+
+func (t *TextBuilder) TableClose() {}
+
+func (t *TextBuilder) Build(document Document) (string, error) {
+	Render(document, t)
+
+	return strings.TrimSpace(t.content.String()) + "\n", nil
+}
+
+func BuildText(input io.Reader, w io.Writer, config BuilderConfig) error {
+	document, err := parse(context.Background(), input, config)
+	if err != nil {
+		return err
+	}
+
+	builder := TextBuilder{Labels: config.Labels}
+
+	out, err := builder.Build(document)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write([]byte(out))
+
+	return err
+}
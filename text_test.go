@@ -0,0 +1,25 @@
+package rulebook
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildText(t *testing.T) {
+	input := "# Combat\n\nRoll **twice**, __then__ see [attack](Attack).\n\n- one *x*\n  - nested\n- two\n\n-table- Weapons\nName|Damage\nSword|d8\n-table-\n\n\\img(orc.png, An orc)\n\n## Attack\n\nHit.\n\nANNEX Bestiary\n"
+
+	var out strings.Builder
+	if err := BuildText(strings.NewReader(input), &out, BuilderConfig{}); err != nil {
+		t.Fatalf("text: %v", err)
+	}
+
+	want := "I - Combat\n\n" +
+		"Roll twice, then see attack.\n" +
+		"- one x\n  - nested\n- two\n\n" +
+		"Weapons\nName\tDamage\nSword\td8\n\n" +
+		"Attack\n\nHit.\n\n" +
+		"Annexe A: Bestiary\n"
+	if out.String() != want {
+		t.Errorf("text:\ngot  %q\nwant %q", out.String(), want)
+	}
+}